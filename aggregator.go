@@ -0,0 +1,114 @@
+package telemetry
+
+import (
+	"github.com/microsoft/ApplicationInsights-Go/appinsights"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultAggregationInterval = time.Minute
+
+// metricAggregator pre-aggregates metric values per name and label set, so that a single AggregateMetricTelemetry
+// per interval is sent to Application Insights instead of one telemetry item per value.
+type metricAggregator struct {
+	mux        sync.Mutex
+	aggregates map[string]*appinsights.AggregateMetricTelemetry
+	send       func(agg *appinsights.AggregateMetricTelemetry)
+	stop       chan struct{}
+	stopped    chan struct{}
+	stopOnce   sync.Once
+}
+
+// newMetricAggregator creates an aggregator that hands the aggregates to send every interval. The default interval
+// is used if interval is not positive.
+func newMetricAggregator(interval time.Duration, send func(agg *appinsights.AggregateMetricTelemetry)) *metricAggregator {
+	if interval <= 0 {
+		interval = defaultAggregationInterval
+	}
+	a := &metricAggregator{
+		aggregates: map[string]*appinsights.AggregateMetricTelemetry{},
+		send:       send,
+		stop:       make(chan struct{}),
+		stopped:    make(chan struct{}),
+	}
+	go a.run(interval)
+	return a
+}
+
+func (a *metricAggregator) run(interval time.Duration) {
+	defer close(a.stopped)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			a.flush()
+		case <-a.stop:
+			return
+		}
+	}
+}
+
+// add adds the value to the aggregate of the metric with the given name and labels.
+func (a *metricAggregator) add(name string, labels map[string]string, value float64) {
+	key := aggregateKey(name, labels)
+
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	agg, ok := a.aggregates[key]
+	if !ok {
+		agg = appinsights.NewAggregateMetricTelemetry(name)
+		for k, v := range labels {
+			agg.Properties[k] = v
+		}
+		a.aggregates[key] = agg
+	}
+	agg.AddData([]float64{value})
+}
+
+// flush sends the aggregates of the current interval and starts a new interval.
+func (a *metricAggregator) flush() {
+	a.mux.Lock()
+	aggregates := a.aggregates
+	a.aggregates = map[string]*appinsights.AggregateMetricTelemetry{}
+	a.mux.Unlock()
+
+	for _, agg := range aggregates {
+		a.send(agg)
+	}
+}
+
+// close stops the aggregator and sends the aggregates of the current interval. It returns when the aggregates have
+// been handed to send, including those of a flush that was in progress.
+func (a *metricAggregator) close() {
+	a.stopOnce.Do(func() {
+		close(a.stop)
+		<-a.stopped
+		a.flush()
+	})
+}
+
+func aggregateKey(name string, labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for k := range labels {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteString(name)
+	b.WriteByte('{')
+	for i, k := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(k)
+		b.WriteByte('=')
+		b.WriteString(labels[k])
+	}
+	b.WriteByte('}')
+	return b.String()
+}
@@ -0,0 +1,158 @@
+package telemetry
+
+import (
+	"context"
+	"github.com/microsoft/ApplicationInsights-Go/appinsights"
+	"math"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test_metricAggregator(t *testing.T) {
+	// Arrange
+	var sent []*appinsights.AggregateMetricTelemetry
+	a := newMetricAggregator(time.Hour, func(agg *appinsights.AggregateMetricTelemetry) {
+		sent = append(sent, agg)
+	})
+
+	// Act
+	for _, v := range []float64{2, 4, 4, 4, 5, 5, 7, 9} {
+		a.add("latency", map[string]string{"code": "200"}, v)
+	}
+	a.add("latency", map[string]string{"code": "500"}, 100)
+	a.close()
+
+	// Assert
+	if len(sent) != 2 {
+		t.Fatalf("expected one aggregate per label set, got %d", len(sent))
+	}
+	var agg *appinsights.AggregateMetricTelemetry
+	for _, s := range sent {
+		if s.Properties["code"] == "200" {
+			agg = s
+		}
+	}
+	if agg == nil {
+		t.Fatal("expected aggregate with code 200")
+	}
+	if agg.Name != "latency" || agg.Count != 8 || agg.Value != 40 || agg.Min != 2 || agg.Max != 9 {
+		t.Errorf("unexpected aggregate %+v", agg)
+	}
+	if math.Sqrt(agg.Variance) != 2 {
+		t.Errorf("expected standard deviation 2, got %v", math.Sqrt(agg.Variance))
+	}
+}
+
+func Test_metricAggregator_flushesEveryInterval(t *testing.T) {
+	// Arrange
+	sent := make(chan *appinsights.AggregateMetricTelemetry, 1)
+	a := newMetricAggregator(10*time.Millisecond, func(agg *appinsights.AggregateMetricTelemetry) {
+		sent <- agg
+	})
+	defer a.close()
+
+	// Act
+	a.add("latency", nil, 1)
+
+	// Assert
+	select {
+	case agg := <-sent:
+		if agg.Count != 1 {
+			t.Errorf("expected count 1, got %d", agg.Count)
+		}
+	case <-time.After(time.Second):
+		t.Error("expected aggregate to be sent")
+	}
+}
+
+func TestTelemetry_Observe_sendsAggregatesToAppInsights(t *testing.T) {
+	// Arrange
+	cpt := &syncCapture{}
+	tm := New(
+		Empty(),
+		Named("monitoring", "cost-monitor"),
+		SendMetricsToAppInsights(),
+		WithAppInsightsAggregationInterval(time.Hour),
+		WithCapture(cpt))
+
+	// Act
+	tm.Observe(Metric{Name: "latency", Value: 10, ConstLabels: map[string]string{"code": "200"}})
+	tm.Observe(Metric{Name: "latency", Value: 20, ConstLabels: map[string]string{"code": "200"}})
+	tm.ObserveSummary(Metric{Name: "duration", Value: 30})
+	_ = tm.Shutdown(context.Background())
+
+	// Assert
+	aggregates := map[string]*appinsights.AggregateMetricTelemetry{}
+	for _, ce := range cpt.events() {
+		if ce.Type == "AggregateMetric" {
+			agg := ce.Event.(*appinsights.AggregateMetricTelemetry)
+			aggregates[agg.Name] = agg
+		}
+	}
+	if agg := aggregates["latency"]; agg == nil || agg.Count != 2 || agg.Value != 30 || agg.Properties["code"] != "200" {
+		t.Errorf("unexpected histogram aggregate %+v", agg)
+	}
+	if agg := aggregates["duration"]; agg == nil || agg.Count != 1 || agg.Properties["system"] != "monitoring" {
+		t.Errorf("unexpected summary aggregate %+v", agg)
+	}
+}
+
+func TestTelemetry_Count_aggregatesInAppInsights(t *testing.T) {
+	// Arrange
+	cpt := &syncCapture{}
+	tm := New(
+		Empty(),
+		SendMetricsToAppInsights(),
+		AggregateMetricsInAppInsights(),
+		WithAppInsightsAggregationInterval(time.Hour),
+		WithCapture(cpt))
+
+	// Act
+	for i := 0; i < 3; i++ {
+		tm.Count(Metric{Name: "cost", Value: 2, ConstLabels: map[string]string{"cloud": "gcp"}})
+	}
+	tm.SetGauge(Metric{Name: "temp", Value: 10})
+	tm.SetGauge(Metric{Name: "temp", Value: 20})
+	_ = tm.Shutdown(context.Background())
+
+	// Assert
+	aggregates := map[string]*appinsights.AggregateMetricTelemetry{}
+	for _, ce := range cpt.events() {
+		switch ce.Type {
+		case "AggregateMetric":
+			agg := ce.Event.(*appinsights.AggregateMetricTelemetry)
+			aggregates[agg.Name] = agg
+		case "Metric":
+			t.Error("did not expect metrics to be sent one by one")
+		}
+	}
+	if agg := aggregates["cost"]; agg == nil || agg.Count != 3 || agg.Value != 6 {
+		t.Errorf("unexpected counter aggregate %+v", agg)
+	}
+	if agg := aggregates["temp"]; agg == nil || agg.Count != 2 || agg.Min != 10 || agg.Max != 20 {
+		t.Errorf("unexpected gauge aggregate %+v", agg)
+	}
+	if !strings.Contains(scrapeHandler(tm.MetricsHandler()), `cost{cloud="gcp"} 6`) {
+		t.Error("expected Prometheus to be updated immediately")
+	}
+}
+
+// syncCapture is a capture that is safe for concurrent use.
+type syncCapture struct {
+	mux      sync.Mutex
+	captured []*CapturedEvent
+}
+
+func (c *syncCapture) Capture(ce *CapturedEvent) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.captured = append(c.captured, ce)
+}
+
+func (c *syncCapture) events() []*CapturedEvent {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return append([]*CapturedEvent(nil), c.captured...)
+}
@@ -0,0 +1,253 @@
+package telemetry
+
+import (
+	"errors"
+	"fmt"
+	"github.com/microsoft/ApplicationInsights-Go/appinsights/contracts"
+	"runtime"
+	"strings"
+)
+
+const (
+	maxStackDepth          = 64
+	defaultErrorMetricName = "errors_total"
+)
+
+// ErrorProperties is implemented by errors that carry custom properties. The properties of all errors in the chain
+// of wrapped errors are added to the exception in Application Insights and to the entry written to the writer, with
+// the properties of outer errors taking precedence.
+type ErrorProperties interface {
+	ErrorProperties() map[string]string
+}
+
+// ErrorWithProperties wraps Err with custom properties, for instance the id of the entity that failed. If Err is
+// nil the properties are reported as the message of the error.
+type ErrorWithProperties struct {
+	Err        error
+	Properties map[string]string
+}
+
+func (e *ErrorWithProperties) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("error with properties %v", e.Properties)
+	}
+	return e.Err.Error()
+}
+
+func (e *ErrorWithProperties) Unwrap() error {
+	return e.Err
+}
+
+func (e *ErrorWithProperties) ErrorProperties() map[string]string {
+	return e.Properties
+}
+
+// WithStack returns an error wrapping err that holds the stack trace of the caller. Errors sent on ErrorChan are
+// handled on the go routine of the logger, so they must be wrapped by WithStack in order for the stack trace of the
+// sender to reach Application Insights. Errors given to Telemetry.Error get the stack trace of the caller unless an
+// error in the chain already holds one. Returns nil if err is nil.
+func WithStack(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &stackError{
+		err:   err,
+		stack: callers(1),
+	}
+}
+
+// WithSeverity returns an error wrapping err that is reported with the given severity instead of LevelError, so
+// that for instance warnings and critical errors can be told apart in Application Insights. If several errors in the
+// chain have a severity, the outermost one is used. The exception keeps the type of err, so that errors of the same
+// cause are grouped regardless of their severity. Returns nil if err is nil.
+func WithSeverity(err error, l Level) error {
+	if err == nil {
+		return nil
+	}
+	return &severityError{
+		err:   err,
+		level: l,
+	}
+}
+
+// severityError is an error with another severity than LevelError.
+type severityError struct {
+	err   error
+	level Level
+}
+
+func (e *severityError) Error() string {
+	return e.err.Error()
+}
+
+func (e *severityError) Unwrap() error {
+	return e.err
+}
+
+// errorSeverity returns the severity of the outermost error in the chain of err that has one, or else LevelError.
+func errorSeverity(err error) Level {
+	for ; err != nil; err = errors.Unwrap(err) {
+		if se, ok := err.(*severityError); ok {
+			return se.level
+		}
+	}
+	return LevelError
+}
+
+// defaultErrorClass is the class of errors counted by the error metric unless another classifier is given by
+// WithErrorClassifier. It is the type of the first error in the chain that is not created by fmt.Errorf or by this
+// package, without the leading *, for instance "net.OpError". If there is no such error, it is the type of the
+// innermost error.
+func defaultErrorClass(err error) string {
+	innermost := err
+	for e := err; e != nil; e = errors.Unwrap(e) {
+		t := fmt.Sprintf("%T", e)
+		if isWrapper(e) || t == "*fmt.wrapError" {
+			innermost = e
+			continue
+		}
+		return strings.TrimPrefix(t, "*")
+	}
+	return strings.TrimPrefix(fmt.Sprintf("%T", innermost), "*")
+}
+
+// isWrapper tells whether err only adds a stack trace, a severity or properties to the error it wraps.
+func isWrapper(err error) bool {
+	switch err.(type) {
+	case *stackError, *severityError, *ErrorWithProperties:
+		return true
+	}
+	return false
+}
+
+// stackError is an error holding the stack trace of where it was created.
+type stackError struct {
+	err   error
+	stack []uintptr
+}
+
+func (e *stackError) Error() string {
+	return e.err.Error()
+}
+
+func (e *stackError) Unwrap() error {
+	return e.err
+}
+
+// callers returns the program counters of the stack of the calling go routine, skipping the caller of callers and
+// the given number of frames above it.
+func callers(skip int) []uintptr {
+	pcs := make([]uintptr, maxStackDepth)
+	n := runtime.Callers(skip+2, pcs)
+	return pcs[:n]
+}
+
+// errorStack returns the stack trace held by the innermost error in the chain of err that holds one, as that is the
+// one closest to where the error occurred.
+func errorStack(err error) []uintptr {
+	var stack []uintptr
+	for ; err != nil; err = errors.Unwrap(err) {
+		if se, ok := err.(*stackError); ok {
+			stack = se.stack
+		}
+	}
+	return stack
+}
+
+// exceptionError returns the first error in the chain of err that does not only add a stack trace, a severity or
+// properties to the error it wraps, so that Application Insights names the exception by the type of that error rather
+// than by the type of a wrapper. Its message is the one of err, as the wrappers take the message of the error they
+// wrap. Returns err if all errors in the chain are wrappers.
+func exceptionError(err error) error {
+	for e := err; e != nil; e = errors.Unwrap(e) {
+		if !isWrapper(e) {
+			return e
+		}
+	}
+	return err
+}
+
+// errorDetails returns the properties describing err: its type, the types and messages of the errors it wraps as
+// cause_1, cause_2 and so on, and the custom properties of the errors in the chain. Errors that only add a stack
+// trace, a severity or properties to the error they wrap are left out of the chain.
+func errorDetails(err error) map[string]string {
+	var chain []error
+	var props []map[string]string
+	for e := err; e != nil; e = errors.Unwrap(e) {
+		if p, ok := e.(ErrorProperties); ok {
+			props = append(props, p.ErrorProperties())
+		}
+		if isWrapper(e) {
+			continue
+		}
+		chain = append(chain, e)
+	}
+
+	d := map[string]string{}
+	for i, e := range chain {
+		if i == 0 {
+			d["error_type"] = fmt.Sprintf("%T", e)
+			continue
+		}
+		d[fmt.Sprintf("cause_%d", i)] = fmt.Sprintf("%T: %s", e, e.Error())
+	}
+	// Inner errors first, so that the properties of outer errors take precedence.
+	for i := len(props) - 1; i >= 0; i-- {
+		for k, v := range props[i] {
+			d[k] = v
+		}
+	}
+	return d
+}
+
+// stackFrames turns the program counters of a stack into Application Insights stack frames, the same way as
+// appinsights.GetCallstack does for the current stack.
+func stackFrames(pcs []uintptr) []*contracts.StackFrame {
+	var stackFrames []*contracts.StackFrame
+	if len(pcs) == 0 {
+		return stackFrames
+	}
+	frames := runtime.CallersFrames(pcs)
+	for level := 0; ; level++ {
+		frame, more := frames.Next()
+		stackFrame := &contracts.StackFrame{
+			Level:    level,
+			FileName: frame.File,
+			Line:     frame.Line,
+			Method:   frame.Function,
+		}
+		if frame.Function != "" {
+			lastSlash := strings.LastIndexByte(frame.Function, '/')
+			if lastSlash < 0 {
+				lastSlash = 0
+			}
+			if firstDot := strings.IndexByte(frame.Function[lastSlash:], '.'); firstDot >= 0 {
+				stackFrame.Assembly = frame.Function[:lastSlash+firstDot]
+				stackFrame.Method = frame.Function[lastSlash+firstDot+1:]
+			}
+		}
+		stackFrames = append(stackFrames, stackFrame)
+		if !more {
+			break
+		}
+	}
+	return stackFrames
+}
+
+// formatStack formats the program counters of a stack the way runtime/debug.Stack does, one function per line
+// followed by its file and line on the next.
+func formatStack(pcs []uintptr) string {
+	if len(pcs) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	frames := runtime.CallersFrames(pcs)
+	for {
+		frame, more := frames.Next()
+		fmt.Fprintf(&b, "%s\n\t%s:%d\n", frame.Function, frame.File, frame.Line)
+		if !more {
+			break
+		}
+	}
+	return b.String()
+}
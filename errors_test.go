@@ -0,0 +1,331 @@
+package telemetry
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/microsoft/ApplicationInsights-Go/appinsights"
+	"github.com/microsoft/ApplicationInsights-Go/appinsights/contracts"
+	"github.com/prometheus/client_golang/prometheus"
+	"io"
+	"strings"
+	"testing"
+)
+
+func Test_errorDetails(t *testing.T) {
+	// Arrange
+	inner := &ErrorWithProperties{
+		Err:        fmt.Errorf("reading costs: %w", io.EOF),
+		Properties: map[string]string{"file": "costs.csv", "attempt": "1"},
+	}
+	err := &ErrorWithProperties{
+		Err:        WithStack(fmt.Errorf("import failed: %w", inner)),
+		Properties: map[string]string{"attempt": "2"},
+	}
+
+	// Act
+	d := errorDetails(err)
+
+	// Assert
+	expected := map[string]string{
+		"error_type": "*fmt.wrapError",
+		"cause_1":    "*fmt.wrapError: reading costs: EOF",
+		"cause_2":    "*errors.errorString: EOF",
+		"file":       "costs.csv",
+		"attempt":    "2",
+	}
+	if len(d) != len(expected) {
+		t.Errorf("expected %v, got %v", expected, d)
+	}
+	for k, v := range expected {
+		if d[k] != v {
+			t.Errorf("expected %s to be %q, got %q", k, v, d[k])
+		}
+	}
+}
+
+func TestWithStack(t *testing.T) {
+	// Act
+	err := WithStack(io.EOF)
+
+	// Assert
+	if !errors.Is(err, io.EOF) {
+		t.Error("expected the stack error to wrap the error")
+	}
+	frames := stackFrames(errorStack(err))
+	if len(frames) == 0 || frames[0].Method != "TestWithStack" {
+		t.Errorf("expected the stack to start in the caller, got %+v", frames)
+	}
+	if WithStack(nil) != nil {
+		t.Error("expected nil for a nil error")
+	}
+}
+
+func TestErrorWithProperties_withoutErr(t *testing.T) {
+	// Arrange
+	buf := new(bytes.Buffer)
+	tm := New(Empty(), WithWriter(buf))
+
+	// Act
+	tm.Error(&ErrorWithProperties{Properties: map[string]string{"file": "costs.csv"}})
+
+	// Assert
+	if !strings.Contains(buf.String(), "error with properties map[file:costs.csv]") {
+		t.Errorf("expected the properties as the message, got %s", buf.String())
+	}
+	if body := scrapeHandler(tm.MetricsHandler()); !strings.Contains(body, `errors_total{class="telemetry.ErrorWithProperties"} 1`) {
+		t.Errorf("expected the error to be counted once by its own type, got %s", body)
+	}
+}
+
+func Test_standardSink_exception(t *testing.T) {
+	// Arrange
+	s := newSink(&OptionsCollector{
+		systemName: "monitoring",
+		appName:    "cost-monitor",
+		empty:      true,
+	}).(*standardSink)
+	err := WithStack(&ErrorWithProperties{
+		Err:        io.EOF,
+		Properties: map[string]string{"file": "costs.csv"},
+	})
+
+	// Act
+	exception := s.exception(err, errorDetails(err), errorStack(err))
+
+	// Assert
+	if exception.Frames[0].Method != "Test_standardSink_exception" {
+		t.Errorf("expected the stack of the error, got %+v", exception.Frames[0])
+	}
+	expected := map[string]string{
+		"error_type": "*errors.errorString",
+		"file":       "costs.csv",
+		"system":     "monitoring",
+		"app":        "cost-monitor",
+	}
+	for k, v := range expected {
+		if exception.Properties[k] != v {
+			t.Errorf("expected %s to be %q, got %q", k, v, exception.Properties[k])
+		}
+	}
+}
+
+func Test_standardSink_exception_typeName(t *testing.T) {
+	s := newSink(&OptionsCollector{empty: true}).(*standardSink)
+	tests := []struct {
+		name        string
+		err         error
+		wantType    string
+		wantMessage string
+	}{
+		{
+			name:        "with stack",
+			err:         WithStack(io.EOF),
+			wantType:    "*errors.errorString",
+			wantMessage: "EOF",
+		},
+		{
+			name:        "with properties",
+			err:         &ErrorWithProperties{Err: fmt.Errorf("reading costs: %w", io.EOF)},
+			wantType:    "*fmt.wrapError",
+			wantMessage: "reading costs: EOF",
+		},
+		{
+			name:        "with severity",
+			err:         WithSeverity(WithStack(io.EOF), LevelWarning),
+			wantType:    "*errors.errorString",
+			wantMessage: "EOF",
+		},
+		{
+			name:        "properties only",
+			err:         &ErrorWithProperties{Properties: map[string]string{"file": "costs.csv"}},
+			wantType:    "*telemetry.ErrorWithProperties",
+			wantMessage: "error with properties map[file:costs.csv]",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			exception := s.exception(tt.err, errorDetails(tt.err), nil)
+
+			details := exception.TelemetryData().(*contracts.ExceptionData).Exceptions[0]
+			if details.TypeName != tt.wantType {
+				t.Errorf("expected type %s, got %s", tt.wantType, details.TypeName)
+			}
+			if details.Message != tt.wantMessage {
+				t.Errorf("expected message %q, got %q", tt.wantMessage, details.Message)
+			}
+		})
+	}
+}
+
+func Test_standardSink_exception_withoutStack(t *testing.T) {
+	// Arrange
+	s := newSink(&OptionsCollector{empty: true}).(*standardSink)
+
+	// Act
+	exception := s.exception(io.EOF, errorDetails(io.EOF), nil)
+
+	// Assert
+	if len(exception.Frames) != 0 {
+		t.Errorf("expected no stack trace, got %+v", exception.Frames)
+	}
+}
+
+func TestTelemetry_Error_writesDetails(t *testing.T) {
+	// Arrange
+	buf := new(bytes.Buffer)
+	tm := New(Empty(), WithWriter(buf), WithFormatter(JSONFormatter()))
+
+	// Act
+	tm.Error(&ErrorWithProperties{
+		Err:        fmt.Errorf("import failed: %w", io.EOF),
+		Properties: map[string]string{"file": "costs.csv"},
+	})
+
+	// Assert
+	var e jsonEntry
+	if err := json.Unmarshal(buf.Bytes(), &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Message != "import failed: EOF" {
+		t.Errorf("unexpected message %q", e.Message)
+	}
+	if e.Properties["file"] != "costs.csv" || e.Properties["cause_1"] != "*errors.errorString: EOF" {
+		t.Errorf("unexpected properties %v", e.Properties)
+	}
+	if !strings.Contains(e.Stack, "TestTelemetry_Error_writesDetails") {
+		t.Errorf("expected the stack of the caller, got %s", e.Stack)
+	}
+}
+
+type notFoundError struct{}
+
+func (notFoundError) Error() string {
+	return "not found"
+}
+
+func Test_defaultErrorClass(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{name: "plain", err: io.EOF, want: "errors.errorString"},
+		{name: "custom type", err: notFoundError{}, want: "telemetry.notFoundError"},
+		{name: "wrapped", err: fmt.Errorf("loading: %w", notFoundError{}), want: "telemetry.notFoundError"},
+		{name: "with stack and severity", err: WithSeverity(WithStack(notFoundError{}), LevelWarning), want: "telemetry.notFoundError"},
+		{name: "properties only", err: WithStack(&ErrorWithProperties{}), want: "telemetry.ErrorWithProperties"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := defaultErrorClass(tt.err); got != tt.want {
+				t.Errorf("defaultErrorClass() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_errorSeverity(t *testing.T) {
+	if l := errorSeverity(io.EOF); l != LevelError {
+		t.Errorf("expected LevelError by default, got %v", l)
+	}
+	err := WithSeverity(fmt.Errorf("wrapped: %w", WithSeverity(io.EOF, LevelWarning)), LevelCritical)
+	if l := errorSeverity(err); l != LevelCritical {
+		t.Errorf("expected the outermost severity, got %v", l)
+	}
+}
+
+func TestTelemetry_Error_countsErrors(t *testing.T) {
+	// Arrange
+	buf := new(bytes.Buffer)
+	tm := New(
+		Empty(),
+		WithWriter(buf),
+		WithErrorMetricName("cost_monitor_errors_total"),
+		WithErrorClassifier(func(err error) string {
+			if errors.Is(err, io.EOF) {
+				return "eof"
+			}
+			return "other"
+		}))
+
+	// Act
+	tm.Error(io.EOF)
+	tm.Error(WithSeverity(fmt.Errorf("reading: %w", io.EOF), LevelWarning))
+	tm.Error(notFoundError{})
+
+	// Assert
+	body := scrapeHandler(tm.MetricsHandler())
+	for _, expected := range []string{`cost_monitor_errors_total{class="eof"} 2`, `cost_monitor_errors_total{class="other"} 1`} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("expected %s, got %s", expected, body)
+		}
+	}
+	if !strings.Contains(buf.String(), "ERROR reading: EOF") {
+		t.Errorf("expected the warning to be written, got %s", buf.String())
+	}
+}
+
+func TestStart_nilError(t *testing.T) {
+	// Arrange
+	buf := new(bytes.Buffer)
+	logChannels := Start(context.Background(), Empty(), WithWriter(buf))
+
+	// Act
+	logChannels.ErrorChan <- nil
+	_ = logChannels.Shutdown(context.Background())
+
+	// Assert
+	if buf.Len() != 0 {
+		t.Errorf("expected nothing to be written, got %s", buf.String())
+	}
+	body := scrape(logChannels)
+	for _, unexpected := range []string{"telemetry_panics_total 1", "errors_total"} {
+		if strings.Contains(body, unexpected) {
+			t.Errorf("did not expect %s, got %s", unexpected, body)
+		}
+	}
+}
+
+func TestTelemetry_Error_counterNotRegistered(t *testing.T) {
+	// Arrange
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(prometheus.NewGauge(prometheus.GaugeOpts{Name: "errors_total", Help: "taken"}))
+	buf := new(bytes.Buffer)
+	tm := New(Empty(), WithWriter(buf), WithPrometheusRegistry(registry, registry))
+
+	// Act
+	tm.Error(io.EOF)
+
+	// Assert
+	output := buf.String()
+	if !strings.Contains(output, "ERROR cannot count error") {
+		t.Errorf("expected the failure to count the error to be written, got %s", output)
+	}
+	if !strings.Contains(output, "ERROR EOF") {
+		t.Errorf("expected the error to be written, got %s", output)
+	}
+}
+
+func Test_standardSink_error_severity(t *testing.T) {
+	// Arrange
+	buf := new(bytes.Buffer)
+	tm := New(Empty(), WithWriter(buf), WithFormatter(JSONFormatter()))
+
+	// Act
+	tm.Error(WithSeverity(io.EOF, LevelCritical))
+
+	// Assert
+	var e jsonEntry
+	if err := json.Unmarshal(buf.Bytes(), &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Level != "Critical" {
+		t.Errorf("expected level Critical, got %s", e.Level)
+	}
+	if LevelCritical.severity() != appinsights.Critical {
+		t.Error("expected LevelCritical to be sent as Critical")
+	}
+}
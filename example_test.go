@@ -4,9 +4,12 @@ import (
 	"context"
 	"errors"
 	"github.com/3lvia/hn-config-lib-go/vault"
+	"github.com/prometheus/client_golang/prometheus"
 	"log"
+	"net/http"
 	"os"
 	"testing"
+	"time"
 )
 
 func TestExample(t *testing.T) {
@@ -28,6 +31,18 @@ func TestExample(t *testing.T) {
 		// Example: EVENT(Start) map[app:cost-monitor handler:h system:monitoring]
 		Named("monitoring", "cost-monitor"),
 
+		// Uses the system and application names given to Named as the Prometheus namespace and subsystem of all
+		// metrics, i.e. 'events_handled' becomes 'monitoring_cost_monitor_events_handled'.
+		NamedAsNamespace(),
+
+		// Rejects metrics with names that contain other characters than letters, digits, underscores, colons,
+		// spaces and hyphens, instead of replacing the invalid characters. Rejected metrics are reported as errors.
+		WithStrictNames(),
+
+		// Gives missing labels empty values when a metric is sent with fewer labels than it was first sent with,
+		// instead of reporting an error.
+		WithLabelPolicy(PadMissingLabels),
+
 		// Will ensure that a connection to Application Insights is not set up, and that it will not be
 		// written to. Overrides both WithAppInsightsSecretPath and WithAppInsightsInstrumentationKey.
 		Empty(),
@@ -42,10 +57,22 @@ func TestExample(t *testing.T) {
 		// here) or to a string buffer for testing purposes.
 		WithWriter(os.Stdout),
 
+		// The format of the entries written to the writer. TextFormatter is the default, while JSONFormatter and
+		// LogfmtFormatter write lines that are easily parsed by log shippers.
+		WithFormatter(JSONFormatter()),
+
 		// Metrics are normally just incremented internally as Prometheus data. If you want to also send metrics
 		// to Application Insights, this can be used.
 		SendMetricsToAppInsights(),
 
+		// Histogram and summary observations are not sent to Application Insights one by one, but aggregated per
+		// name and label set (count, sum, min, max and standard deviation) and sent once per interval.
+		WithAppInsightsAggregationInterval(30 * time.Second),
+
+		// Aggregates counters and gauges sent to Application Insights the same way, instead of sending each update.
+		// Prometheus is still updated immediately.
+		AggregateMetricsInAppInsights(),
+
 		// All logging events are sent to the given capture. This is implemented as a feature that us useful
 		// during unit testing when it may be desirable to be able to examine the logging events that application
 		// raises.
@@ -55,6 +82,48 @@ func TestExample(t *testing.T) {
 		// before a histogram event of that name is ever raised.
 		AddHistogramBucketSpec("my_histogram", []float64{50, 60, 70, 80, 90, 100, 110}),
 		AddHistogramBucketSpec("my_other_histogram", []float64{1000, 2000, 3000, 4000, 5000}),
+
+		// Buckets may also be given for all histograms with names matching a pattern, and as a default for all
+		// histograms. LinearBuckets and ExponentialBuckets help create bucket layouts.
+		AddHistogramBucketSpecPattern("http_*_latency", ExponentialBuckets(5, 2, 12)),
+		WithDefaultHistogramBuckets(LinearBuckets(100, 100, 10)),
+
+		// Gives the ability to tailor the quantiles of named Prometheus summaries. NB! Must be invoked before a
+		// summary event of that name is ever raised.
+		AddSummarySpec("my_summary", SummarySpec{
+			Objectives: map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001},
+			MaxAge:     5 * time.Minute,
+		}),
+
+		// The maximum time to wait for queued telemetry to be delivered to Application Insights when the logger is
+		// stopped, either by cancelling ctx or by calling Shutdown on the returned LogChannels.
+		WithShutdownTimeout(10 * time.Second),
+
+		// How long telemetry sent on the channels after the logger has stopped is discarded instead of blocking the
+		// sender.
+		WithDiscardPeriod(time.Minute),
+
+		// Buffers each channel so that sending telemetry does not wait for the logger. When a buffer is full, the
+		// overflow policy decides whether the sender blocks (default) or whether telemetry is dropped.
+		WithBufferSize(1000),
+		WithOverflowPolicy(DropOldest, CountChannel, HistogramChannel),
+
+		// Prometheus metrics are registered with a registry that is private to this logger unless another registry
+		// is given, here the global Prometheus registry.
+		WithPrometheusRegistry(prometheus.DefaultRegisterer, prometheus.DefaultGatherer),
+
+		// Discards trace messages below the given level, as well as debug messages unless the level is LevelDebug.
+		WithMinimumLevel(LevelInfo),
+
+		// Errors are counted by a Prometheus counter labeled by class. These set its name and the func deciding the
+		// class of an error.
+		WithErrorMetricName("cost_monitor_errors_total"),
+		WithErrorClassifier(func(err error) string {
+			if errors.Is(err, context.DeadlineExceeded) {
+				return "timeout"
+			}
+			return "other"
+		}),
 		)
 
 	////////////////////// USAGE
@@ -69,9 +138,23 @@ func TestExample(t *testing.T) {
 	// Send an error! Is sent to Application Insights (if configured).
 	logChannels.ErrorChan <- errors.New("an error has occurred")
 
+	// Send an error with custom properties and the stack trace of the sender!
+	logChannels.ErrorChan <- WithStack(&ErrorWithProperties{
+		Err:        errors.New("cost file is empty"),
+		Properties: map[string]string{"file": "costs.csv"},
+	})
+
 	// Send some debug information! This is only sent to io.Writer if it is configured.
 	logChannels.DebugChan <- "some debug information"
 
+	// Send a trace message! Is sent to Application Insights (if configured) with the given severity, and to
+	// io.Writer if it is configured.
+	logChannels.TraceChan <- Trace{
+		Level:   LevelWarning,
+		Message: "cost file was empty",
+		Fields:  map[string]string{"file": "costs.csv"},
+	}
+
 	// Increment a Prometheus counter!
 	logChannels.CountChan <- Metric {
 		Name:        "Events handled", // will be transformed to 'events_handled'
@@ -86,9 +169,25 @@ func TestExample(t *testing.T) {
 		ConstLabels: nil,
 	}
 
+	// Increase a Prometheus gauge, for instance when a handler starts, and decrease it when it is done!
+	logChannels.GaugeChan <- Metric{
+		Name:           "Concurrent handlers",
+		GaugeOperation: GaugeInc,
+	}
+
 	logChannels.HistogramChan <- Metric{
 		Name:        "http_handler_latency",
 		Value:       182.12,
 		ConstLabels: map[string]string{"code": "200"},
 	}
+
+	// Observe a Prometheus summary!
+	logChannels.SummaryChan <- Metric{
+		Name:        "my_summary",
+		Value:       182.12,
+		ConstLabels: map[string]string{"code": "200"},
+	}
+
+	// Expose the Prometheus metrics maintained by the logger!
+	http.Handle("/metrics", logChannels.MetricsHandler())
 }
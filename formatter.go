@@ -0,0 +1,225 @@
+package telemetry
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The kinds of entries written to the writer.
+const (
+	KindEvent = "event"
+	KindError = "error"
+	KindDebug = "debug"
+	KindTrace = "trace"
+)
+
+// LogEntry is a single entry written to the writer given by WithWriter.
+type LogEntry struct {
+	// Time is when the entry was written.
+	Time time.Time
+
+	// Kind is one of KindEvent, KindError, KindDebug and KindTrace.
+	Kind string
+
+	// Name is the name of an event, empty for other kinds.
+	Name string
+
+	// Level is the level of a trace message. Events have LevelInfo, errors LevelError and debug messages LevelDebug.
+	Level Level
+
+	// Message is the message of a trace, error or debug message, empty for events.
+	Message string
+
+	// System and App are the names given to Named.
+	System string
+	App    string
+
+	// Properties are the data of an event, the fields of a trace message or the details of an error.
+	Properties map[string]string
+
+	// Stack is the stack trace of an error, if known.
+	Stack string
+}
+
+// Formatter turns a LogEntry into the bytes written to the writer, normally a single line.
+type Formatter interface {
+	Format(e LogEntry) []byte
+}
+
+// FormatterFunc lets a func be used as a Formatter.
+type FormatterFunc func(e LogEntry) []byte
+
+func (f FormatterFunc) Format(e LogEntry) []byte {
+	return f(e)
+}
+
+// TextFormatter returns the default formatter, which writes human readable lines such as
+// "2020-11-02 13:04:05  EVENT(Start) map[app:cost-monitor handler:h system:monitoring]".
+func TextFormatter() Formatter {
+	return FormatterFunc(formatText)
+}
+
+// JSONFormatter returns a formatter that writes each entry as a JSON object on a line of its own, with the keys
+// time, kind, name, level, message, system, app, properties and stack. Empty values are left out.
+func JSONFormatter() Formatter {
+	return FormatterFunc(formatJSON)
+}
+
+// LogfmtFormatter returns a formatter that writes each entry as a line of logfmt key=value pairs, starting with the
+// keys time, kind, name, level, msg, system and app and followed by the properties sorted by key and the stack.
+// Properties named by one of these keys are prefixed by "prop.", for instance prop.time.
+func LogfmtFormatter() Formatter {
+	return FormatterFunc(formatLogfmt)
+}
+
+func formatText(e LogEntry) []byte {
+	var b strings.Builder
+	b.WriteString(e.Time.Format("2006-01-02 15:04:05"))
+	b.WriteString("  ")
+	b.WriteString(strings.ToUpper(e.Kind))
+	label := e.Name
+	if e.Kind == KindTrace {
+		label = e.Level.String()
+	}
+	if label != "" {
+		fmt.Fprintf(&b, "(%s)", label)
+	}
+	if e.Message != "" {
+		b.WriteString(" ")
+		b.WriteString(e.Message)
+	}
+	props := make(map[string]string, len(e.Properties)+2)
+	for k, v := range e.Properties {
+		props[k] = v
+	}
+	if e.System != "" {
+		props["system"] = e.System
+	}
+	if e.App != "" {
+		props["app"] = e.App
+	}
+	if len(props) > 0 {
+		fmt.Fprintf(&b, " %v", props)
+	}
+	b.WriteString("\n")
+	b.WriteString(e.Stack)
+	return []byte(b.String())
+}
+
+type jsonEntry struct {
+	Time       string            `json:"time"`
+	Kind       string            `json:"kind"`
+	Name       string            `json:"name,omitempty"`
+	Level      string            `json:"level"`
+	Message    string            `json:"message,omitempty"`
+	System     string            `json:"system,omitempty"`
+	App        string            `json:"app,omitempty"`
+	Properties map[string]string `json:"properties,omitempty"`
+	Stack      string            `json:"stack,omitempty"`
+}
+
+func formatJSON(e LogEntry) []byte {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	// Encoding a struct of strings cannot fail.
+	_ = enc.Encode(jsonEntry{
+		Time:       e.Time.Format(time.RFC3339Nano),
+		Kind:       e.Kind,
+		Name:       e.Name,
+		Level:      e.Level.String(),
+		Message:    e.Message,
+		System:     e.System,
+		App:        e.App,
+		Properties: e.Properties,
+		Stack:      e.Stack,
+	})
+	return buf.Bytes()
+}
+
+func formatLogfmt(e LogEntry) []byte {
+	var b strings.Builder
+	writePair := func(k, v string) {
+		if b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString(logfmtKey(k))
+		b.WriteByte('=')
+		b.WriteString(logfmtValue(v))
+	}
+	writePair("time", e.Time.Format(time.RFC3339Nano))
+	writePair("kind", e.Kind)
+	if e.Name != "" {
+		writePair("name", e.Name)
+	}
+	writePair("level", e.Level.String())
+	if e.Message != "" {
+		writePair("msg", e.Message)
+	}
+	if e.System != "" {
+		writePair("system", e.System)
+	}
+	if e.App != "" {
+		writePair("app", e.App)
+	}
+	keys := make([]string, 0, len(e.Properties))
+	for k := range e.Properties {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		writePair(logfmtPropertyKey(k), e.Properties[k])
+	}
+	if e.Stack != "" {
+		writePair("stack", e.Stack)
+	}
+	b.WriteByte('\n')
+	return []byte(b.String())
+}
+
+// logfmtReservedKeys are the keys of the fields of a LogEntry, which properties must not repeat.
+var logfmtReservedKeys = map[string]bool{
+	"time":   true,
+	"kind":   true,
+	"name":   true,
+	"level":  true,
+	"msg":    true,
+	"system": true,
+	"app":    true,
+	"stack":  true,
+}
+
+// logfmtPropertyKey prefixes the key of a property by "prop." if it is one of the keys of the fields of the entry, so
+// that no key appears twice on a line.
+func logfmtPropertyKey(k string) string {
+	if logfmtReservedKeys[logfmtKey(k)] {
+		return "prop." + k
+	}
+	return k
+}
+
+// logfmtKey replaces the characters that are not allowed in a logfmt key by underscores.
+func logfmtKey(k string) string {
+	if k == "" {
+		return "_"
+	}
+	return strings.Map(func(r rune) rune {
+		if r <= ' ' || r == '=' || r == '"' {
+			return '_'
+		}
+		return r
+	}, k)
+}
+
+// logfmtValue quotes v if it is empty or contains characters that would otherwise break the line apart.
+func logfmtValue(v string) string {
+	if v == "" || strings.ContainsAny(v, " =\"\\") || strings.IndexFunc(v, func(r rune) bool { return r < ' ' }) >= 0 {
+		return strconv.Quote(v)
+	}
+	return v
+}
@@ -0,0 +1,151 @@
+package telemetry
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testEntry() LogEntry {
+	return LogEntry{
+		Time:       time.Date(2020, 11, 2, 13, 4, 5, 0, time.UTC),
+		Kind:       KindEvent,
+		Name:       "Start",
+		Level:      LevelInfo,
+		System:     "monitoring",
+		App:        "cost-monitor",
+		Properties: map[string]string{"handler": "h"},
+	}
+}
+
+func TestTextFormatter(t *testing.T) {
+	tests := []struct {
+		name  string
+		entry func(e LogEntry) LogEntry
+		want  string
+	}{
+		{
+			name:  "event",
+			entry: func(e LogEntry) LogEntry { return e },
+			want:  "2020-11-02 13:04:05  EVENT(Start) map[app:cost-monitor handler:h system:monitoring]\n",
+		},
+		{
+			name: "trace",
+			entry: func(e LogEntry) LogEntry {
+				e.Kind, e.Name, e.Level, e.Message = KindTrace, "", LevelWarning, "cost file was empty"
+				return e
+			},
+			want: "2020-11-02 13:04:05  TRACE(Warning) cost file was empty map[app:cost-monitor handler:h system:monitoring]\n",
+		},
+		{
+			name: "debug",
+			entry: func(e LogEntry) LogEntry {
+				return LogEntry{Time: e.Time, Kind: KindDebug, Message: "debug"}
+			},
+			want: "2020-11-02 13:04:05  DEBUG debug\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := string(TextFormatter().Format(tt.entry(testEntry())))
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestJSONFormatter(t *testing.T) {
+	// Act
+	line := JSONFormatter().Format(testEntry())
+
+	// Assert
+	if !bytes.HasSuffix(line, []byte("\n")) || bytes.Count(line, []byte("\n")) != 1 {
+		t.Errorf("expected a single line, got %q", line)
+	}
+	var got map[string]interface{}
+	if err := json.Unmarshal(line, &got); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"time":   "2020-11-02T13:04:05Z",
+		"kind":   "event",
+		"name":   "Start",
+		"level":  "Info",
+		"system": "monitoring",
+		"app":    "cost-monitor",
+	}
+	for k, v := range expected {
+		if got[k] != v {
+			t.Errorf("expected %s to be %q, got %v", k, v, got[k])
+		}
+	}
+	if props, ok := got["properties"].(map[string]interface{}); !ok || props["handler"] != "h" {
+		t.Errorf("unexpected properties %v", got["properties"])
+	}
+	if _, ok := got["message"]; ok {
+		t.Error("expected empty message to be left out")
+	}
+}
+
+func TestLogfmtFormatter(t *testing.T) {
+	// Arrange
+	e := testEntry()
+	e.Kind, e.Name, e.Level, e.Message = KindError, "", LevelError, "failed:\n\"x\""
+	e.Properties = map[string]string{"b": "with space", "a": "", "c=d": "1"}
+
+	// Act
+	got := string(LogfmtFormatter().Format(e))
+
+	// Assert
+	want := `time=2020-11-02T13:04:05Z kind=error level=Error msg="failed:\n\"x\"" system=monitoring app=cost-monitor a="" b="with space" c_d=1` + "\n"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestLogfmtFormatter_reservedKeys(t *testing.T) {
+	// Arrange
+	e := testEntry()
+	e.Properties = map[string]string{"time": "x", "msg": "y", "handler": "h"}
+
+	// Act
+	got := string(LogfmtFormatter().Format(e))
+
+	// Assert
+	want := `time=2020-11-02T13:04:05Z kind=event name=Start level=Info system=monitoring app=cost-monitor handler=h prop.msg=y prop.time=x` + "\n"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestWithFormatter(t *testing.T) {
+	// Arrange
+	buf := new(bytes.Buffer)
+	tm := New(
+		Empty(),
+		Named("monitoring", "cost-monitor"),
+		WithWriter(buf),
+		WithFormatter(JSONFormatter()))
+
+	// Act
+	tm.Debug("debug")
+	tm.Event(Event{Name: "Start"})
+
+	// Assert
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines, got %q", buf.String())
+	}
+	for _, l := range lines {
+		var e jsonEntry
+		if err := json.Unmarshal([]byte(l), &e); err != nil {
+			t.Fatalf("expected JSON, got %q: %v", l, err)
+		}
+		if e.System != "monitoring" || e.App != "cost-monitor" {
+			t.Errorf("expected system and app, got %q", l)
+		}
+	}
+}
@@ -6,4 +6,5 @@ require (
 	github.com/3lvia/hn-config-lib-go v1.2.1
 	github.com/microsoft/ApplicationInsights-Go v0.4.3
 	github.com/prometheus/client_golang v1.7.1
+	github.com/prometheus/client_model v0.2.0
 )
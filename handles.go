@@ -0,0 +1,162 @@
+package telemetry
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// MetricSpec declares a metric up front, so that a handle to it can be kept and used on hot paths without the
+// overhead of looking up the metric by name for every observation.
+type MetricSpec struct {
+	// Name is the name of the metric, which is transformed into a Prometheus name the same way as Metric.Name.
+	Name string
+
+	// Help describes the metric in Prometheus. Defaults to Name.
+	Help string
+
+	// Namespace is the first part of the Prometheus name of the metric, see Metric.Namespace.
+	Namespace string
+
+	// Subsystem is the second part of the Prometheus name of the metric, see Metric.Subsystem.
+	Subsystem string
+
+	// LabelNames are the names of the labels of the metric, in the order their values are given to WithLabelValues.
+	LabelNames []string
+
+	// Buckets are the upper inclusive bounds of the buckets of a histogram. Defaults to the buckets given by
+	// AddHistogramBucketSpec. Not used for other metric types.
+	Buckets []float64
+}
+
+func (s MetricSpec) metric() Metric {
+	l := make(map[string]string, len(s.LabelNames))
+	for _, n := range s.LabelNames {
+		l[n] = ""
+	}
+	return Metric{
+		Name:        s.Name,
+		ConstLabels: l,
+		Help:        s.Help,
+		Namespace:   s.Namespace,
+		Subsystem:   s.Subsystem,
+	}
+}
+
+// labelOrder maps the label names of the spec onto the sorted label names of the registered vector. The result
+// is nil if the label names are sorted already.
+func (s MetricSpec) labelOrder(fqName string, schema []string) ([]int, error) {
+	if len(s.LabelNames) != len(schema) {
+		return nil, labelMismatchError(fqName, s.LabelNames, schema)
+	}
+	position := make(map[string]int, len(s.LabelNames))
+	for i, n := range s.LabelNames {
+		position[promoLabelName(n)] = i
+	}
+	order := make([]int, len(schema))
+	sorted := true
+	for i, n := range schema {
+		p, ok := position[n]
+		if !ok {
+			return nil, labelMismatchError(fqName, s.LabelNames, schema)
+		}
+		order[i] = p
+		sorted = sorted && p == i
+	}
+	if sorted {
+		return nil, nil
+	}
+	return order, nil
+}
+
+// CounterHandle is a handle to a Prometheus counter vector declared by Telemetry.NewCounter.
+type CounterHandle struct {
+	vector *prometheus.CounterVec
+	order  []int
+}
+
+// WithLabelValues returns the counter with the given label values, in the order of MetricSpec.LabelNames. The
+// returned counter may be kept and used directly. Panics if the number of values differs from the number of labels.
+func (h *CounterHandle) WithLabelValues(values ...string) prometheus.Counter {
+	return h.vector.WithLabelValues(reorder(values, h.order)...)
+}
+
+// GaugeHandle is a handle to a Prometheus gauge vector declared by Telemetry.NewGauge.
+type GaugeHandle struct {
+	vector *prometheus.GaugeVec
+	order  []int
+}
+
+// WithLabelValues returns the gauge with the given label values, in the order of MetricSpec.LabelNames. The
+// returned gauge may be kept and used directly. Panics if the number of values differs from the number of labels.
+func (h *GaugeHandle) WithLabelValues(values ...string) prometheus.Gauge {
+	return h.vector.WithLabelValues(reorder(values, h.order)...)
+}
+
+// HistogramHandle is a handle to a Prometheus histogram vector declared by Telemetry.NewHistogram.
+type HistogramHandle struct {
+	vector *prometheus.HistogramVec
+	order  []int
+}
+
+// WithLabelValues returns the histogram with the given label values, in the order of MetricSpec.LabelNames. The
+// returned histogram may be kept and used directly. Panics if the number of values differs from the number of
+// labels.
+func (h *HistogramHandle) WithLabelValues(values ...string) prometheus.Observer {
+	return h.vector.WithLabelValues(reorder(values, h.order)...)
+}
+
+// NewCounter declares a counter and returns a handle to it. The counter is the same as the one updated by Count
+// for metrics with the same name.
+func (t *Telemetry) NewCounter(spec MetricSpec) (*CounterHandle, error) {
+	v := t.sink.metrics()
+	m := spec.metric()
+	vector, schema, err := v.ensureCountVector(m)
+	if err != nil {
+		return nil, err
+	}
+	order, err := spec.labelOrder(v.fqName(m), schema)
+	if err != nil {
+		return nil, err
+	}
+	return &CounterHandle{vector: vector, order: order}, nil
+}
+
+// NewGauge declares a gauge and returns a handle to it. The gauge is the same as the one updated by SetGauge for
+// metrics with the same name.
+func (t *Telemetry) NewGauge(spec MetricSpec) (*GaugeHandle, error) {
+	v := t.sink.metrics()
+	m := spec.metric()
+	vector, schema, err := v.ensureGaugeVector(m)
+	if err != nil {
+		return nil, err
+	}
+	order, err := spec.labelOrder(v.fqName(m), schema)
+	if err != nil {
+		return nil, err
+	}
+	return &GaugeHandle{vector: vector, order: order}, nil
+}
+
+// NewHistogram declares a histogram and returns a handle to it. The histogram is the same as the one updated by
+// Observe for metrics with the same name.
+func (t *Telemetry) NewHistogram(spec MetricSpec) (*HistogramHandle, error) {
+	v := t.sink.metrics()
+	m := spec.metric()
+	vector, schema, err := v.ensureHistogramVector(m, spec.Buckets)
+	if err != nil {
+		return nil, err
+	}
+	order, err := spec.labelOrder(v.fqName(m), schema)
+	if err != nil {
+		return nil, err
+	}
+	return &HistogramHandle{vector: vector, order: order}, nil
+}
+
+func reorder(values []string, order []int) []string {
+	if order == nil || len(values) != len(order) {
+		return values
+	}
+	r := make([]string, len(order))
+	for i, p := range order {
+		r[i] = values[p]
+	}
+	return r
+}
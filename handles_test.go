@@ -0,0 +1,125 @@
+package telemetry
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestTelemetry_NewCounter(t *testing.T) {
+	// Arrange
+	tm := New(Empty())
+	h, err := tm.NewCounter(MetricSpec{
+		Name:       "requests",
+		Help:       "Number of requests.",
+		LabelNames: []string{"method", "code"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Act
+	c := h.WithLabelValues("GET", "200")
+	c.Inc()
+	c.Inc()
+	tm.Count(Metric{
+		Name:        "requests",
+		Value:       1,
+		ConstLabels: map[string]string{"method": "GET", "code": "200"},
+	})
+
+	// Assert
+	body := scrapeHandler(tm.MetricsHandler())
+	if !strings.Contains(body, `requests{code="200",method="GET"} 3`) {
+		t.Errorf("expected handle and Count to update the same counter, got %s", body)
+	}
+}
+
+func TestTelemetry_NewHistogram(t *testing.T) {
+	// Arrange
+	tm := New(Empty())
+	h, err := tm.NewHistogram(MetricSpec{
+		Name:       "latency",
+		LabelNames: []string{"handler"},
+		Buckets:    []float64{10, 100},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Act
+	h.WithLabelValues("costs").Observe(50)
+
+	// Assert
+	body := scrapeHandler(tm.MetricsHandler())
+	if !strings.Contains(body, `latency_bucket{handler="costs",le="100"} 1`) {
+		t.Errorf("expected histogram with the declared buckets, got %s", body)
+	}
+}
+
+func TestTelemetry_NewGauge_labelMismatch(t *testing.T) {
+	// Arrange
+	tm := New(Empty())
+	tm.SetGauge(Metric{
+		Name:        "temp",
+		Value:       1,
+		ConstLabels: map[string]string{"room": "bathroom"},
+	})
+
+	// Act
+	_, err := tm.NewGauge(MetricSpec{
+		Name:       "temp",
+		LabelNames: []string{"house"},
+	})
+
+	// Assert
+	if err == nil {
+		t.Error("expected label mismatch to be reported")
+	}
+}
+
+func BenchmarkLogChannels_count(b *testing.B) {
+	logChannels := Start(context.Background(), Empty())
+	defer logChannels.Shutdown(context.Background())
+	m := Metric{
+		Name:        "requests",
+		Value:       1,
+		ConstLabels: map[string]string{"method": "GET", "code": "200"},
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		logChannels.CountChan <- m
+	}
+}
+
+func BenchmarkTelemetry_Count(b *testing.B) {
+	tm := New(Empty())
+	m := Metric{
+		Name:        "requests",
+		Value:       1,
+		ConstLabels: map[string]string{"method": "GET", "code": "200"},
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tm.Count(m)
+	}
+}
+
+func BenchmarkCounterHandle(b *testing.B) {
+	tm := New(Empty())
+	h, err := tm.NewCounter(MetricSpec{
+		Name:       "requests",
+		LabelNames: []string{"method", "code"},
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	c := h.WithLabelValues("GET", "200")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.Inc()
+	}
+}
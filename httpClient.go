@@ -0,0 +1,130 @@
+package telemetry
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// InstrumentTransport wraps next so that the http requests sent through it are sent to the logger. If next is nil,
+// http.DefaultTransport is used. The following metrics are maintained, labeled by the host of the request and the
+// http method:
+//   - http_client_requests_total (count) the number of requests that got a response, also labeled by status code.
+//   - http_client_latency (histogram) the latency in milliseconds of these requests, also labeled by status code.
+//   - http_client_errors_total (count) the number of requests that failed without a response.
+//
+// Each request is also sent to Application Insights as a dependency of type HTTP, named by the method and host of the
+// request unless another name is given by WithDependencyName. The URL of the request is kept as the data of the
+// dependency, leaving out the query, as it may hold secrets.
+//
+//	client := &http.Client{Transport: telemetry.InstrumentTransport(nil, logChannels)}
+func InstrumentTransport(next http.RoundTripper, logChannels LogChannels, opts ...TransportOption) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	t := &transport{
+		next:           next,
+		logChannels:    logChannels,
+		dependencyName: methodAndHost,
+	}
+	for _, opt := range opts {
+		opt(t)
+	}
+	return t
+}
+
+// TransportOption specifies options for configuring the transport created by InstrumentTransport.
+type TransportOption func(*transport)
+
+// WithDependencyName names the dependency of each request by name instead of by the method and host of the request,
+// for instance by the method and route template of the request. The name should not hold the raw path of the
+// request, as Application Insights groups dependencies by name.
+func WithDependencyName(name func(req *http.Request) string) TransportOption {
+	return func(t *transport) {
+		t.dependencyName = name
+	}
+}
+
+type transport struct {
+	next           http.RoundTripper
+	logChannels    LogChannels
+	dependencyName func(req *http.Request) string
+}
+
+func methodAndHost(req *http.Request) string {
+	return fmt.Sprintf("%s %s", req.Method, req.URL.Host)
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+
+	resp, err := t.next.RoundTrip(req)
+
+	elapsed := time.Since(start)
+
+	t.registerMetrics(req, resp, err, elapsed)
+	t.logChannels.DependencyChan <- t.dependency(req, resp, err, start, elapsed)
+
+	return resp, err
+}
+
+func (t *transport) registerMetrics(req *http.Request, resp *http.Response, err error, elapsed time.Duration) {
+	labels := map[string]string{
+		"host":   req.URL.Host,
+		"method": req.Method,
+	}
+	if err != nil {
+		t.logChannels.CountChan <- Metric{
+			Name:        "http_client_errors_total",
+			Value:       1,
+			Help:        "The total number of outgoing http requests that failed without a response.",
+			ConstLabels: labels,
+		}
+		return
+	}
+
+	labels["code"] = fmt.Sprintf("%d", resp.StatusCode)
+	t.logChannels.CountChan <- Metric{
+		Name:        "http_client_requests_total",
+		Value:       1,
+		Help:        "The total number of outgoing http requests that got a response.",
+		ConstLabels: labels,
+	}
+	t.logChannels.HistogramChan <- Metric{
+		Name:        "http_client_latency",
+		Value:       float64(elapsed.Milliseconds()),
+		Help:        "The latency in milliseconds of outgoing http requests that got a response.",
+		ConstLabels: copyLabels(labels),
+	}
+}
+
+// dependency describes the request as a dependency. The request succeeded if it got a response with a status code
+// below 400.
+func (t *transport) dependency(
+	req *http.Request, resp *http.Response, err error, start time.Time, elapsed time.Duration) Dependency {
+	d := Dependency{
+		Name:     t.dependencyName(req),
+		Type:     "HTTP",
+		Target:   req.URL.Host,
+		Data:     (&url.URL{Scheme: req.URL.Scheme, Host: req.URL.Host, Path: req.URL.Path}).String(),
+		Start:    start,
+		Duration: elapsed,
+	}
+	if err != nil {
+		d.Properties = map[string]string{"error": err.Error()}
+		return d
+	}
+	d.ResultCode = fmt.Sprintf("%d", resp.StatusCode)
+	d.Success = resp.StatusCode < 400
+	return d
+}
+
+// copyLabels returns a copy of labels, as the logger may hold on to the labels of a metric.
+func copyLabels(labels map[string]string) map[string]string {
+	c := make(map[string]string, len(labels))
+	for k, v := range labels {
+		c[k] = v
+	}
+	return c
+}
@@ -0,0 +1,138 @@
+package telemetry
+
+import (
+	"context"
+	"errors"
+	"github.com/microsoft/ApplicationInsights-Go/appinsights"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestInstrumentTransport(t *testing.T) {
+	// Arrange
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/missing" {
+			http.NotFound(rw, req)
+			return
+		}
+		rw.Write([]byte("costs"))
+	}))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	cpt := &syncCapture{}
+	logChannels := Start(context.Background(), Empty(), WithCapture(cpt))
+	client := &http.Client{Transport: InstrumentTransport(nil, logChannels)}
+
+	// Act
+	for _, path := range []string{"/costs?token=secret", "/missing"} {
+		resp, err := client.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	_ = logChannels.Shutdown(context.Background())
+
+	// Assert
+	body := scrape(logChannels)
+	expected := []string{
+		`http_client_requests_total{code="200",host="` + host + `",method="GET"} 1`,
+		`http_client_requests_total{code="404",host="` + host + `",method="GET"} 1`,
+		`http_client_latency_count{code="200",host="` + host + `",method="GET"} 1`,
+	}
+	for _, e := range expected {
+		if !strings.Contains(body, e) {
+			t.Errorf("expected body to contain %s", e)
+		}
+	}
+
+	var dependencies []*appinsights.RemoteDependencyTelemetry
+	for _, ce := range cpt.events() {
+		if ce.Type == "Dependency" {
+			dependencies = append(dependencies, ce.Event.(*appinsights.RemoteDependencyTelemetry))
+		}
+	}
+	if len(dependencies) != 2 {
+		t.Fatalf("expected 2 dependencies, got %d", len(dependencies))
+	}
+	ok, missing := dependencies[0], dependencies[1]
+	if ok.Name != "GET "+host || ok.Type != "HTTP" || ok.Target != host || ok.ResultCode != "200" || !ok.Success {
+		t.Errorf("unexpected dependency %+v", ok)
+	}
+	if ok.Data != server.URL+"/costs" {
+		t.Errorf("expected the query to be left out of the data, got %s", ok.Data)
+	}
+	if missing.ResultCode != "404" || missing.Success {
+		t.Errorf("expected an unsuccessful dependency, got %+v", missing)
+	}
+}
+
+func TestInstrumentTransport_error(t *testing.T) {
+	// Arrange
+	cpt := &syncCapture{}
+	logChannels := Start(context.Background(), Empty(), WithCapture(cpt))
+	failing := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		return nil, errors.New("connection refused")
+	})
+	client := &http.Client{Transport: InstrumentTransport(failing, logChannels)}
+
+	// Act
+	_, err := client.Get("http://costs.example.com/costs")
+	_ = logChannels.Shutdown(context.Background())
+
+	// Assert
+	if err == nil {
+		t.Fatal("expected the error of the transport")
+	}
+	if !strings.Contains(scrape(logChannels), `http_client_errors_total{host="costs.example.com",method="GET"} 1`) {
+		t.Error("expected the error to be counted")
+	}
+	events := cpt.events()
+	if len(events) == 0 || events[len(events)-1].Type != "Dependency" {
+		t.Fatalf("expected a dependency, got %v", events)
+	}
+	d := events[len(events)-1].Event.(*appinsights.RemoteDependencyTelemetry)
+	if d.Success || d.Properties["error"] != "connection refused" {
+		t.Errorf("unexpected dependency %+v", d)
+	}
+}
+
+func TestInstrumentTransport_dependencyName(t *testing.T) {
+	// Arrange
+	cpt := &syncCapture{}
+	logChannels := Start(context.Background(), Empty(), WithCapture(cpt))
+	ok := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: 200, Body: http.NoBody}, nil
+	})
+	name := WithDependencyName(func(req *http.Request) string {
+		return req.Method + " /costs/{id}"
+	})
+	client := &http.Client{Transport: InstrumentTransport(ok, logChannels, name)}
+
+	// Act
+	resp, err := client.Get("http://costs.example.com/costs/42")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	_ = logChannels.Shutdown(context.Background())
+
+	// Assert
+	events := cpt.events()
+	if len(events) == 0 || events[len(events)-1].Type != "Dependency" {
+		t.Fatalf("expected a dependency, got %v", events)
+	}
+	d := events[len(events)-1].Event.(*appinsights.RemoteDependencyTelemetry)
+	if d.Name != "GET /costs/{id}" || d.Data != "http://costs.example.com/costs/42" {
+		t.Errorf("unexpected dependency %+v", d)
+	}
+}
+
+type roundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
@@ -0,0 +1,79 @@
+package telemetry
+
+import (
+	"fmt"
+	"github.com/microsoft/ApplicationInsights-Go/appinsights"
+	"github.com/microsoft/ApplicationInsights-Go/appinsights/contracts"
+	"strings"
+)
+
+// Level is the severity of a trace message.
+type Level int
+
+const (
+	// LevelDebug is for detailed information that is useful when debugging. Messages sent on DebugChan have this
+	// level.
+	LevelDebug Level = iota
+
+	// LevelInfo is for information about the normal operation of the application.
+	LevelInfo
+
+	// LevelWarning is for unexpected situations that the application recovers from.
+	LevelWarning
+
+	// LevelError is for failures that affect a single operation.
+	LevelError
+
+	// LevelCritical is for failures that affect the application as a whole.
+	LevelCritical
+)
+
+var levelNames = map[Level]string{
+	LevelDebug:    "Debug",
+	LevelInfo:     "Info",
+	LevelWarning:  "Warning",
+	LevelError:    "Error",
+	LevelCritical: "Critical",
+}
+
+func (l Level) String() string {
+	if n, ok := levelNames[l]; ok {
+		return n
+	}
+	return fmt.Sprintf("Level(%d)", int(l))
+}
+
+// ParseLevel returns the level with the given name, ignoring case, for instance "warning". This lets the minimum
+// level be read from configuration or the environment.
+func ParseLevel(s string) (Level, error) {
+	for l, n := range levelNames {
+		if strings.EqualFold(s, n) {
+			return l, nil
+		}
+	}
+	return LevelDebug, fmt.Errorf("unknown log level %q", s)
+}
+
+// severity is the Application Insights severity level corresponding to l.
+func (l Level) severity() contracts.SeverityLevel {
+	switch l {
+	case LevelDebug:
+		return appinsights.Verbose
+	case LevelInfo:
+		return appinsights.Information
+	case LevelWarning:
+		return appinsights.Warning
+	case LevelError:
+		return appinsights.Error
+	default:
+		return appinsights.Critical
+	}
+}
+
+// Trace is a log message with a severity level and structured fields. It is sent to Application Insights as a trace
+// and written to the writer.
+type Trace struct {
+	Level   Level
+	Message string
+	Fields  map[string]string
+}
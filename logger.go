@@ -2,81 +2,237 @@ package telemetry
 
 import (
 	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	"reflect"
+	"sync"
+	"time"
 )
 
 // Start starts the logger in a go routine and returns a set of channels
-// that can be used to send telemetry to the logger.
+// that can be used to send telemetry to the logger. The logger runs until
+// ctx is cancelled or LogChannels.Shutdown is called, after which it drains
+// the messages already queued on the channels and flushes Application Insights.
+// The go routine of the logger then discards the telemetry sent on the
+// channels for the period set by WithDiscardPeriod before it returns.
 func Start(ctx context.Context, opts ...Option) LogChannels {
-	collector := &OptionsCollector{
-		sendMetricsToAppInsights: false,
-		empty:                    false,
-	}
-	for _, opt := range opts {
-		opt(collector)
-	}
+	return New(opts...).Start(ctx)
+}
 
-	s := newSink(collector)
+// Start starts a logger in a go routine that forwards the telemetry sent on the returned channels to t. The
+// logger runs until ctx is cancelled or LogChannels.Shutdown is called, after which it drains the messages already
+// queued on the channels and shuts t down. The go routine of the logger then discards the telemetry sent on the
+// channels for the period set by WithDiscardPeriod before it returns.
+func (t *Telemetry) Start(ctx context.Context) LogChannels {
+	overflows := map[Channel]overflow{}
+	for _, c := range allChannels {
+		o := overflow{
+			size:   t.bufferSize,
+			policy: t.overflows[c],
+		}
+		if o.forwarding() {
+			o.dropped = t.sink.selfCounter(Metric{
+				Name:        droppedMetricName,
+				Help:        droppedMetricHelp,
+				ConstLabels: map[string]string{"channel": string(c)},
+			})
+		}
+		overflows[c] = o
+	}
 
 	l := &logger{
-		sink:                     s,
-		sendMetricsToAppInsights: collector.sendMetricsToAppInsights,
+		t:         t,
+		overflows: overflows,
+		done:      make(chan struct{}),
 	}
 
-	lg := l.getLogChannels()
+	ctx, cancel := context.WithCancel(ctx)
+	lg := l.getLogChannels(ctx)
+	l.channels = lg
+	lg.done = l.done
+	lg.gatherer = t.gatherer
+	lg.cancel = cancel
+	lg.gaugeDrops = overflows[GaugeChannel].forwarding()
 	go l.start(ctx)
 	return lg
 }
 
 type logger struct {
-	sink                     sink
-	gaugeChan                <-chan Metric
-	counterChan              <-chan Metric
-	histogramChan            <-chan Metric
-	errorChan                <-chan error
-	eventChan                <-chan Event
-	debugChan                <-chan string
-
-	sendMetricsToAppInsights bool
+	t              *Telemetry
+	gaugeChan      <-chan Metric
+	counterChan    <-chan Metric
+	histogramChan  <-chan Metric
+	summaryChan    <-chan Metric
+	errorChan      <-chan error
+	eventChan      <-chan Event
+	debugChan      <-chan string
+	traceChan      <-chan Trace
+	dependencyChan <-chan Dependency
+	done           chan struct{}
+	overflows      map[Channel]overflow
+	channels       LogChannels
+	forwarders     sync.WaitGroup
 }
 
 func (l *logger) start(ctx context.Context) {
+	for l.next(ctx) {
+	}
+	l.discard(l.t.discardPeriod)
+}
+
+// next handles a single message. It returns false when ctx is done and the logger has stopped.
+func (l *logger) next(ctx context.Context) bool {
+	select {
+	case <-ctx.Done():
+		l.stop()
+		return false
+	case c := <-l.counterChan:
+		l.t.Count(c)
+	case g := <-l.gaugeChan:
+		l.t.SetGauge(g)
+	case h := <-l.histogramChan:
+		l.t.Observe(h)
+	case sm := <-l.summaryChan:
+		l.t.ObserveSummary(sm)
+	case err := <-l.errorChan:
+		l.t.queuedError(err)
+	case e := <-l.eventChan:
+		l.t.Event(e)
+	case d := <-l.debugChan:
+		l.t.Debug(d)
+	case tr := <-l.traceChan:
+		l.t.Trace(tr)
+	case d := <-l.dependencyChan:
+		l.t.Dependency(d)
+	}
+	return true
+}
+
+// stop waits for the forwarders to return, handles the messages that are already waiting on the channels, flushes
+// the sink and signals that the logger is done. Messages sent after this point are discarded.
+func (l *logger) stop() {
+	defer close(l.done)
+	l.forwarders.Wait()
+	for l.drainOne() {
+	}
+	l.t.sink.close(l.t.shutdownTimeout)
+}
+
+func (l *logger) drainOne() bool {
+	select {
+	case c := <-l.counterChan:
+		l.t.Count(c)
+	case g := <-l.gaugeChan:
+		l.t.SetGauge(g)
+	case h := <-l.histogramChan:
+		l.t.Observe(h)
+	case sm := <-l.summaryChan:
+		l.t.ObserveSummary(sm)
+	case err := <-l.errorChan:
+		l.t.queuedError(err)
+	case e := <-l.eventChan:
+		l.t.Event(e)
+	case d := <-l.debugChan:
+		l.t.Debug(d)
+	case tr := <-l.traceChan:
+		l.t.Trace(tr)
+	case d := <-l.dependencyChan:
+		l.t.Dependency(d)
+	default:
+		return false
+	}
+	return true
+}
+
+// discard receives the telemetry sent on the channels for the period d after the logger has stopped, so that senders
+// do not block, for instance http handlers that are still running during a graceful shutdown. The telemetry is
+// counted as dropped.
+func (l *logger) discard(d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	dropped := map[Channel]prometheus.Counter{}
 	for {
+		var c Channel
 		select {
-		case c := <-l.counterChan:
-			l.sink.handleCounter(c)
-		case g := <-l.gaugeChan:
-			l.sink.handleGauge(g)
-		case h := <-l.histogramChan:
-			l.sink.handleHistogram(h)
-		case err := <-l.errorChan:
-			l.sink.error(err)
-		case e := <-l.eventChan:
-			l.sink.logEvent(e.Name, e.Data)
-		case d := <-l.debugChan:
-			l.sink.debug(d)
+		case <-timer.C:
+			return
+		case <-l.channels.CountChan:
+			c = CountChannel
+		case <-l.channels.GaugeChan:
+			c = GaugeChannel
+		case <-l.channels.HistogramChan:
+			c = HistogramChannel
+		case <-l.channels.SummaryChan:
+			c = SummaryChannel
+		case <-l.channels.ErrorChan:
+			c = ErrorChannel
+		case <-l.channels.EventChan:
+			c = EventChannel
+		case <-l.channels.DebugChan:
+			c = DebugChannel
+		case <-l.channels.TraceChan:
+			c = TraceChannel
+		case <-l.channels.DependencyChan:
+			c = DependencyChannel
+		}
+		if dropped[c] == nil {
+			dropped[c] = l.overflows[c].dropped
+		}
+		if dropped[c] == nil {
+			dropped[c] = l.t.sink.selfCounter(Metric{
+				Name:        droppedMetricName,
+				Help:        droppedMetricHelp,
+				ConstLabels: map[string]string{"channel": string(c)},
+			})
 		}
+		dropped[c].Inc()
 	}
 }
 
-func (l *logger) getLogChannels() LogChannels {
-	gaugeChan := make(chan Metric)
-	histogramChan := make(chan Metric)
-	errorChan := make(chan error)
-	eventChan := make(chan Event)
-	debugChan := make(chan string)
-	counterChan := make(chan Metric)
-	l.gaugeChan = gaugeChan
-	l.errorChan = errorChan
-	l.eventChan = eventChan
-	l.debugChan = debugChan
-	l.counterChan = counterChan
-	l.histogramChan = histogramChan
+func (l *logger) getLogChannels(ctx context.Context) LogChannels {
+	gaugeChan := make(chan Metric, l.overflows[GaugeChannel].clientBufferSize())
+	histogramChan := make(chan Metric, l.overflows[HistogramChannel].clientBufferSize())
+	summaryChan := make(chan Metric, l.overflows[SummaryChannel].clientBufferSize())
+	errorChan := make(chan error, l.overflows[ErrorChannel].clientBufferSize())
+	eventChan := make(chan Event, l.overflows[EventChannel].clientBufferSize())
+	debugChan := make(chan string, l.overflows[DebugChannel].clientBufferSize())
+	counterChan := make(chan Metric, l.overflows[CountChannel].clientBufferSize())
+	traceChan := make(chan Trace, l.overflows[TraceChannel].clientBufferSize())
+	dependencyChan := make(chan Dependency, l.overflows[DependencyChannel].clientBufferSize())
+	l.gaugeChan = l.queue(ctx, GaugeChannel, gaugeChan).(chan Metric)
+	l.errorChan = l.queue(ctx, ErrorChannel, errorChan).(chan error)
+	l.eventChan = l.queue(ctx, EventChannel, eventChan).(chan Event)
+	l.debugChan = l.queue(ctx, DebugChannel, debugChan).(chan string)
+	l.counterChan = l.queue(ctx, CountChannel, counterChan).(chan Metric)
+	l.histogramChan = l.queue(ctx, HistogramChannel, histogramChan).(chan Metric)
+	l.summaryChan = l.queue(ctx, SummaryChannel, summaryChan).(chan Metric)
+	l.traceChan = l.queue(ctx, TraceChannel, traceChan).(chan Trace)
+	l.dependencyChan = l.queue(ctx, DependencyChannel, dependencyChan).(chan Dependency)
 	return LogChannels{
-		GaugeChan:     gaugeChan,
-		ErrorChan:     errorChan,
-		EventChan:     eventChan,
-		DebugChan:     debugChan,
-		CountChan:     counterChan,
-		HistogramChan: histogramChan,
+		GaugeChan:      gaugeChan,
+		ErrorChan:      errorChan,
+		EventChan:      eventChan,
+		DebugChan:      debugChan,
+		CountChan:      counterChan,
+		HistogramChan:  histogramChan,
+		SummaryChan:    summaryChan,
+		TraceChan:      traceChan,
+		DependencyChan: dependencyChan,
+	}
+}
+
+// queue returns the channel the logger reads the telemetry sent on in from. This is in itself unless the channel c
+// has a drop policy, in which case a forwarder is started. The returned channel has the same type as in. The
+// forwarder returns when ctx is done, which the logger waits for before draining the queue.
+func (l *logger) queue(ctx context.Context, c Channel, in interface{}) interface{} {
+	o := l.overflows[c]
+	if !o.forwarding() {
+		return in
 	}
+	out := reflect.MakeChan(reflect.TypeOf(in), o.queueSize()).Interface()
+	l.forwarders.Add(1)
+	go func() {
+		defer l.forwarders.Done()
+		forward(ctx, in, out, o)
+	}()
+	return out
 }
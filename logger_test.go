@@ -4,11 +4,13 @@ import (
 	"bytes"
 	"context"
 	"errors"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
 	"net/http/httptest"
+	"runtime"
 	"strings"
 	"sync"
 	"testing"
+	"time"
 )
 
 func TestStart_forAppInsights(t *testing.T) {
@@ -63,7 +65,7 @@ func TestStart_forMetrics(t *testing.T) {
 	expectedGcp := `cost{cloud="gcp"} 3.14`
 	expectedAzure := `cost{cloud="azure"} 100.11`
 	expectedGauge := `temp{room="bathroom"} 12.12`
-	expectedHistogram := `# HELP latency 
+	expectedHistogram := `# HELP latency latency
 # TYPE latency histogram
 latency_bucket{handler="metrics",le="0.005"} 0
 latency_bucket{handler="metrics",le="0.01"} 0
@@ -146,7 +148,7 @@ latency_count{handler="metrics"} 2`
 	}()
 
 	rr := httptest.NewRecorder()
-	handler := promhttp.Handler()
+	handler := logChannels.MetricsHandler()
 
 	wg := &sync.WaitGroup{}
 	wg.Add(7)
@@ -181,6 +183,351 @@ latency_count{handler="metrics"} 2`
 	//fmt.Print(body)
 }
 
+func TestStart_namespaceAndHelp(t *testing.T) {
+	// Arrange
+	doneChan := make(chan struct{})
+	cpt := &mockCapture{
+		ch: doneChan,
+	}
+	logChannels := Start(context.Background(),
+		Empty(),
+		Named("monitoring", "cost-monitor"),
+		NamedAsNamespace(),
+		WithCapture(cpt))
+
+	// Act
+	go func() {
+		logChannels.CountChan <- Metric{
+			Name:  "Events handled",
+			Value: 1,
+		}
+		logChannels.GaugeChan <- Metric{
+			Name:      "temp",
+			Value:     2,
+			Help:      "Temperature in the room.",
+			Namespace: "house",
+			Subsystem: "sensors",
+		}
+	}()
+	<-doneChan
+	<-doneChan
+
+	// Assert
+	body := scrape(logChannels)
+	expected := []string{
+		"# HELP monitoring_cost_monitor_events_handled Events handled",
+		"monitoring_cost_monitor_events_handled 1",
+		"# HELP house_sensors_temp Temperature in the room.",
+		"house_sensors_temp 2",
+	}
+	for _, e := range expected {
+		if !strings.Contains(body, e) {
+			t.Errorf("expected body to contain %s", e)
+		}
+	}
+}
+
+func TestStart_forSummaries(t *testing.T) {
+	// Arrange
+	doneChan := make(chan struct{})
+	cpt := &mockCapture{
+		ch: doneChan,
+	}
+	logChannels := Start(context.Background(),
+		Empty(),
+		WithCapture(cpt),
+		AddSummarySpec("latency", SummarySpec{
+			Objectives: map[float64]float64{0.5: 0.05, 0.95: 0.01},
+			MaxAge:     time.Minute,
+		}))
+
+	// Act
+	go func() {
+		for _, v := range []float64{10, 20, 30} {
+			logChannels.SummaryChan <- Metric{
+				Name:        "latency",
+				Value:       v,
+				ConstLabels: map[string]string{"handler": "costs"},
+			}
+		}
+		logChannels.SummaryChan <- Metric{Name: "duration", Value: 1}
+	}()
+	for i := 0; i < 4; i++ {
+		<-doneChan
+	}
+
+	// Assert
+	body := scrape(logChannels)
+	expected := []string{
+		`latency{handler="costs",quantile="0.5"} 20`,
+		`latency{handler="costs",quantile="0.95"} 30`,
+		`latency_count{handler="costs"} 3`,
+		`duration{quantile="0.99"} 1`,
+	}
+	for _, e := range expected {
+		if !strings.Contains(body, e) {
+			t.Errorf("expected body to contain %s", e)
+		}
+	}
+	if cpt.captured[0].Type != "Summary" {
+		t.Errorf("expected captured summary, got %s", cpt.captured[0].Type)
+	}
+}
+
+func TestStart_sanitizedNames(t *testing.T) {
+	// Arrange
+	doneChan := make(chan struct{})
+	cpt := &mockCapture{
+		ch: doneChan,
+	}
+	logChannels := Start(context.Background(), Empty(), WithCapture(cpt))
+
+	// Act
+	go func() {
+		logChannels.CountChan <- Metric{
+			Name:        "Cost (NOK)/day",
+			Value:       1,
+			ConstLabels: map[string]string{"cloud provider": "gcp"},
+		}
+	}()
+	<-doneChan
+
+	// Assert
+	if !strings.Contains(scrape(logChannels), `cost_nok_day{cloud_provider="gcp"} 1`) {
+		t.Error("expected sanitized metric")
+	}
+}
+
+func TestStart_strictNames(t *testing.T) {
+	// Arrange
+	doneChan := make(chan struct{})
+	cpt := &mockCapture{
+		ch: doneChan,
+	}
+	logChannels := Start(context.Background(), Empty(), WithStrictNames(), WithCapture(cpt))
+
+	// Act
+	go func() {
+		logChannels.CountChan <- Metric{
+			Name:  "Cost (NOK)/day",
+			Value: 1,
+		}
+	}()
+	<-doneChan
+
+	// Assert
+	if cpt.captured[0].Type != "Error" {
+		t.Errorf("expected invalid name to be reported as an error, got %s", cpt.captured[0].Type)
+	}
+	if strings.Contains(scrape(logChannels), "cost_nok_day") {
+		t.Error("did not expect the invalid metric to be registered")
+	}
+}
+
+func TestStart_separateRegistries(t *testing.T) {
+	// Arrange
+	doneChan := make(chan struct{})
+	cpt := &mockCapture{
+		ch: doneChan,
+	}
+	first := Start(context.Background(), Empty(), WithCapture(cpt))
+	second := Start(context.Background(), Empty())
+
+	// Act
+	go func() {
+		first.CountChan <- Metric{
+			Name:  "only in first",
+			Value: 1,
+		}
+	}()
+	<-doneChan
+
+	// Assert
+	firstBody := scrape(first)
+	secondBody := scrape(second)
+	if !strings.Contains(firstBody, "only_in_first 1") {
+		t.Error("expected metric in the first registry")
+	}
+	if strings.Contains(secondBody, "only_in_first") {
+		t.Error("did not expect metric in the second registry")
+	}
+}
+
+func TestStart_registrationError(t *testing.T) {
+	// Arrange
+	doneChan := make(chan struct{})
+	cpt := &mockCapture{
+		ch: doneChan,
+	}
+	logChannels := Start(context.Background(), Empty(), WithCapture(cpt))
+
+	// Act
+	go func() {
+		logChannels.CountChan <- Metric{Name: "conflict", Value: 1}
+		logChannels.GaugeChan <- Metric{Name: "conflict", Value: 1}
+	}()
+	<-doneChan
+	<-doneChan
+
+	// Assert
+	if len(cpt.captured) != 2 {
+		t.Fatalf("expected 2 captured events, got %d", len(cpt.captured))
+	}
+	if cpt.captured[1].Type != "Error" {
+		t.Errorf("expected registration failure to be reported as an error, got %s", cpt.captured[1].Type)
+	}
+}
+
+func TestStart_recoversPanics(t *testing.T) {
+	// Arrange
+	buf := new(bytes.Buffer)
+	logChannels := Start(context.Background(),
+		Empty(),
+		WithCapture(&panickingCapture{}),
+		WithWriter(buf))
+
+	// Act
+	logChannels.EventChan <- Event{Name: "boom"}
+	logChannels.DebugChan <- "still alive"
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_ = logChannels.Shutdown(shutdownCtx)
+
+	// Assert
+	output := buf.String()
+	if !strings.Contains(output, "recovered panic in telemetry logger: capture failed map[") {
+		t.Error("expected the panic to be reported by its value only")
+	}
+	if !strings.Contains(output, "telemetry-go.(*panickingCapture).Capture\n") {
+		t.Error("expected the stack trace of the panic to start at the panicking function")
+	}
+	if !strings.Contains(output, "still alive") {
+		t.Error("expected the logger to keep running after the panic")
+	}
+	body := scrape(logChannels)
+	if !strings.Contains(body, "telemetry_panics_total 1") {
+		t.Error("expected the panic to be counted")
+	}
+	if !strings.Contains(body, "# HELP telemetry_panics_total "+panicsMetricHelp) {
+		t.Errorf("expected the help of the panic counter, got %s", body)
+	}
+}
+
+func TestStart_shutdown(t *testing.T) {
+	// Arrange
+	buf := new(bytes.Buffer)
+	logChannels := Start(context.Background(),
+		Empty(),
+		WithWriter(buf))
+
+	logChannels.DebugChan <- "before shutdown"
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	// Act
+	err := logChannels.Shutdown(shutdownCtx)
+
+	// Assert
+	if err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	select {
+	case <-logChannels.Done():
+	default:
+		t.Error("expected done channel to be closed")
+	}
+	if !strings.Contains(buf.String(), "before shutdown") {
+		t.Error("expected debug message sent before shutdown to be written")
+	}
+}
+
+func TestStart_cancelledContext(t *testing.T) {
+	// Arrange
+	ctx, cancel := context.WithCancel(context.Background())
+	logChannels := Start(ctx, Empty())
+
+	// Act
+	cancel()
+
+	// Assert
+	select {
+	case <-logChannels.Done():
+	case <-time.After(time.Second):
+		t.Error("expected logger to stop when the context is cancelled")
+	}
+}
+
+func TestStart_sendAfterDone(t *testing.T) {
+	// Arrange
+	ctx, cancel := context.WithCancel(context.Background())
+	logChannels := Start(ctx, Empty(), WithBufferSize(1), WithOverflowPolicy(DropOldest, ErrorChannel))
+	cancel()
+	<-logChannels.Done()
+
+	// Act
+	sent := make(chan struct{})
+	go func() {
+		logChannels.CountChan <- Metric{Name: "after done", Value: 1}
+		logChannels.CountChan <- Metric{Name: "after done", Value: 1}
+		logChannels.ErrorChan <- errors.New("after done")
+		// The previous messages have been counted once the next one is received.
+		logChannels.DebugChan <- "after done"
+		close(sent)
+	}()
+
+	// Assert
+	select {
+	case <-sent:
+	case <-time.After(time.Second):
+		t.Fatal("expected sends after the logger has stopped not to block")
+	}
+	body := scrape(logChannels)
+	for _, expected := range []string{
+		"# HELP telemetry_dropped_total " + droppedMetricHelp,
+		`telemetry_dropped_total{channel="count"} 2`,
+		`telemetry_dropped_total{channel="error"} 1`,
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("expected %s, got %s", expected, body)
+		}
+	}
+	if strings.Contains(body, "after_done") {
+		t.Error("did not expect telemetry sent after the logger has stopped to be handled")
+	}
+}
+
+func TestStart_discardPeriod(t *testing.T) {
+	// Arrange
+	before := runtime.NumGoroutine()
+
+	// Act
+	for i := 0; i < 20; i++ {
+		logChannels := Start(context.Background(), Empty(), WithDiscardPeriod(time.Millisecond))
+		_ = logChannels.Shutdown(context.Background())
+	}
+
+	// Assert
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("expected the go routines of the loggers to return, %d before and %d after", before, after)
+	}
+}
+
+func scrape(logChannels LogChannels) string {
+	return scrapeHandler(logChannels.MetricsHandler())
+}
+
+func scrapeHandler(h http.Handler) string {
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	h.ServeHTTP(rr, req)
+	return rr.Body.String()
+}
+
 
 //////////////////////////
 ///
@@ -196,4 +543,12 @@ type mockCapture struct {
 func (m *mockCapture) Capture(ce *CapturedEvent) {
 	m.captured = append(m.captured, ce)
 	m.ch <- struct{}{}
-}
\ No newline at end of file
+}
+
+type panickingCapture struct{}
+
+func (p *panickingCapture) Capture(ce *CapturedEvent) {
+	if ce.Type == "Event" {
+		panic("capture failed")
+	}
+}
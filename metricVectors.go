@@ -1,126 +1,397 @@
 package telemetry
 
 import (
+	"fmt"
 	"github.com/prometheus/client_golang/prometheus"
+	"path"
 	"sort"
 	"sync"
+	"time"
 )
 
 type metricVectors struct {
-	mux                  *sync.Mutex
+	mux                  *sync.RWMutex
+	registerer           prometheus.Registerer
+	namespace            string
+	subsystem            string
+	strictNames          bool
 	counters             map[string]*prometheus.CounterVec
 	gauges               map[string]*prometheus.GaugeVec
 	histograms           map[string]*prometheus.HistogramVec
 	histogramBucketSpecs map[string][]float64
+	histogramPatterns    []bucketPattern
+	defaultBuckets       []float64
+	summaries            map[string]*prometheus.SummaryVec
+	summarySpecs         map[string]SummarySpec
+	labelSchemas         map[string][]string
+	labelPolicy          LabelPolicy
 }
 
-func (v *metricVectors) getCounter(m Metric) prometheus.Counter {
-	vector := v.ensureCountVector(m)
-	return vector.With(m.ConstLabels)
+// SummarySpec configures a Prometheus summary, see AddSummarySpec.
+type SummarySpec struct {
+	// Objectives maps the quantiles to calculate to their absolute error, i.e. {0.99: 0.001} calculates the 99th
+	// percentile with an error of 0.1%. Defaults to the 50th, 90th and 99th percentiles when nil, while an empty map
+	// calculates no quantiles.
+	Objectives map[float64]float64
+
+	// MaxAge is how long observations are taken into account. Defaults to 10 minutes.
+	MaxAge time.Duration
+
+	// AgeBuckets is the number of buckets used to exclude observations older than MaxAge. Defaults to 5.
+	AgeBuckets uint32
 }
 
-func (v *metricVectors) ensureCountVector(m Metric) *prometheus.CounterVec {
-	key := vectorKey(m)
-	if vector, ok := v.counters[key]; ok {
-		return vector
+var defaultSummaryObjectives = map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001}
+
+// LabelPolicy decides what happens when a metric is sent with other label names than the ones the metric with the
+// same name was first registered with.
+type LabelPolicy int
+
+const (
+	// RejectMismatchedLabels reports metrics with mismatched label names as errors. This is the default policy.
+	RejectMismatchedLabels LabelPolicy = iota
+
+	// PadMissingLabels gives missing labels empty values. Metrics with labels that the registered metric does not
+	// have are reported as errors.
+	PadMissingLabels
+)
+
+func (v *metricVectors) getCounter(m Metric) (prometheus.Counter, error) {
+	vector, schema, err := v.ensureCountVector(m)
+	if err != nil {
+		return nil, err
+	}
+	l, err := v.labelsFor(m, schema)
+	if err != nil {
+		return nil, err
+	}
+	return vector.With(l), nil
+}
+
+// ensureCountVector returns the vector of the metric and the sorted names of the labels it was registered with,
+// registering it if this is the first time the metric is seen.
+func (v *metricVectors) ensureCountVector(m Metric) (*prometheus.CounterVec, []string, error) {
+	if v.strictNames {
+		if err := checkNames(m); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	key := v.fqName(m)
+	v.mux.RLock()
+	vector, ok := v.counters[key]
+	schema := v.labelSchemas[key]
+	v.mux.RUnlock()
+	if ok {
+		return vector, schema, nil
 	}
 
 	v.mux.Lock()
 	defer v.mux.Unlock()
 
 	if vector, ok := v.counters[key]; ok {
-		return vector
+		return vector, v.labelSchemas[key], nil
 	}
 
 	opts := prometheus.CounterOpts{
-		Name:        m.toPromoMetricName(),
+		Namespace: v.namespaceOf(m),
+		Subsystem: v.subsystemOf(m),
+		Name:      m.toPromoMetricName(),
+		Help:      m.help(),
+	}
+	schema = sortedLabelNames(m)
+	vector = prometheus.NewCounterVec(opts, schema)
+	if err := v.registerer.Register(vector); err != nil {
+		are, ok := err.(prometheus.AlreadyRegisteredError)
+		if !ok {
+			return nil, nil, registrationError(v.fqName(m), err)
+		}
+		existing, ok := are.ExistingCollector.(*prometheus.CounterVec)
+		if !ok {
+			return nil, nil, registrationError(v.fqName(m), err)
+		}
+		vector = existing
 	}
-	vector := prometheus.NewCounterVec(opts, labelNames(m))
-	_ = prometheus.Register(vector)
 	v.counters[key] = vector
+	v.labelSchemas[key] = schema
 
-
-	return vector
+	return vector, schema, nil
 }
 
-func (v *metricVectors) getGauge(m Metric) prometheus.Gauge {
-	vector := v.ensureGaugeVector(m)
-	return vector.With(m.ConstLabels)
+func (v *metricVectors) getGauge(m Metric) (prometheus.Gauge, error) {
+	vector, schema, err := v.ensureGaugeVector(m)
+	if err != nil {
+		return nil, err
+	}
+	l, err := v.labelsFor(m, schema)
+	if err != nil {
+		return nil, err
+	}
+	return vector.With(l), nil
 }
 
-func (v *metricVectors) ensureGaugeVector(m Metric) *prometheus.GaugeVec {
-	key := vectorKey(m)
-	if vector, ok := v.gauges[key]; ok {
-		return vector
+// ensureGaugeVector returns the vector of the metric and the sorted names of the labels it was registered with,
+// registering it if this is the first time the metric is seen.
+func (v *metricVectors) ensureGaugeVector(m Metric) (*prometheus.GaugeVec, []string, error) {
+	if v.strictNames {
+		if err := checkNames(m); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	key := v.fqName(m)
+	v.mux.RLock()
+	vector, ok := v.gauges[key]
+	schema := v.labelSchemas[key]
+	v.mux.RUnlock()
+	if ok {
+		return vector, schema, nil
 	}
 
 	v.mux.Lock()
 	defer v.mux.Unlock()
 
 	if vector, ok := v.gauges[key]; ok {
-		return vector
+		return vector, v.labelSchemas[key], nil
 	}
 
 	opts := prometheus.GaugeOpts{
-		Name:        m.toPromoMetricName(),
+		Namespace: v.namespaceOf(m),
+		Subsystem: v.subsystemOf(m),
+		Name:      m.toPromoMetricName(),
+		Help:      m.help(),
+	}
+	schema = sortedLabelNames(m)
+	vector = prometheus.NewGaugeVec(opts, schema)
+	if err := v.registerer.Register(vector); err != nil {
+		are, ok := err.(prometheus.AlreadyRegisteredError)
+		if !ok {
+			return nil, nil, registrationError(v.fqName(m), err)
+		}
+		existing, ok := are.ExistingCollector.(*prometheus.GaugeVec)
+		if !ok {
+			return nil, nil, registrationError(v.fqName(m), err)
+		}
+		vector = existing
 	}
-	vector := prometheus.NewGaugeVec(opts, labelNames(m))
-	_ = prometheus.Register(vector)
 	v.gauges[key] = vector
-	return vector
+	v.labelSchemas[key] = schema
+	return vector, schema, nil
 }
 
-func (v *metricVectors) getHistogram(m Metric) prometheus.Observer {
-	vector := v.ensureHistogramVector(m)
-	return vector.With(m.ConstLabels)
+func (v *metricVectors) getHistogram(m Metric) (prometheus.Observer, error) {
+	vector, schema, err := v.ensureHistogramVector(m, nil)
+	if err != nil {
+		return nil, err
+	}
+	l, err := v.labelsFor(m, schema)
+	if err != nil {
+		return nil, err
+	}
+	return vector.With(l), nil
 }
 
-func (v *metricVectors) ensureHistogramVector(m Metric) *prometheus.HistogramVec {
-	key := vectorKey(m)
-	if vector, ok := v.histograms[key]; ok {
-		return vector
+// ensureHistogramVector returns the vector of the metric and the sorted names of the labels it was registered with,
+// registering it with the given buckets if this is the first time the metric is seen. If buckets is nil the buckets
+// given by the options are used, see bucketsFor.
+func (v *metricVectors) ensureHistogramVector(m Metric, buckets []float64) (*prometheus.HistogramVec, []string, error) {
+	if err := checkReservedLabel(m, "le", "histograms"); err != nil {
+		return nil, nil, err
+	}
+	if v.strictNames {
+		if err := checkNames(m); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	key := v.fqName(m)
+	v.mux.RLock()
+	vector, ok := v.histograms[key]
+	schema := v.labelSchemas[key]
+	v.mux.RUnlock()
+	if ok {
+		return vector, schema, nil
 	}
 
 	v.mux.Lock()
 	defer v.mux.Unlock()
 
 	if vector, ok := v.histograms[key]; ok {
-		return vector
+		return vector, v.labelSchemas[key], nil
 	}
 
-	var buckets []float64
-	k := m.toPromoMetricName()
-	if b, ok := v.histogramBucketSpecs[k]; ok {
-		buckets = b
+	if buckets == nil {
+		buckets = v.bucketsFor(m.toPromoMetricName())
 	}
 
 	opts := prometheus.HistogramOpts{
+		Namespace: v.namespaceOf(m),
+		Subsystem: v.subsystemOf(m),
 		Name:      m.toPromoMetricName(),
+		Help:      m.help(),
 		Buckets:   buckets,
 	}
-	vector := prometheus.NewHistogramVec(opts, labelNames(m))
-	_ = prometheus.Register(vector)
+	schema = sortedLabelNames(m)
+	vector = prometheus.NewHistogramVec(opts, schema)
+	if err := v.registerer.Register(vector); err != nil {
+		are, ok := err.(prometheus.AlreadyRegisteredError)
+		if !ok {
+			return nil, nil, registrationError(v.fqName(m), err)
+		}
+		existing, ok := are.ExistingCollector.(*prometheus.HistogramVec)
+		if !ok {
+			return nil, nil, registrationError(v.fqName(m), err)
+		}
+		vector = existing
+	}
 	v.histograms[key] = vector
-	return vector
+	v.labelSchemas[key] = schema
+	return vector, schema, nil
 }
 
-func vectorKey(m Metric) string {
-	key := m.toPromoMetricName()
-	ln := labelNames(m)
-	sort.Strings(ln)
+// bucketsFor returns the buckets of the histogram with the given name. A spec given for the name takes precedence
+// over the first matching pattern, which again takes precedence over the default buckets. Returns nil if none of
+// these are given, in which case the Prometheus default buckets are used.
+func (v *metricVectors) bucketsFor(name string) []float64 {
+	if b, ok := v.histogramBucketSpecs[name]; ok {
+		return b
+	}
+	for _, p := range v.histogramPatterns {
+		if ok, _ := path.Match(p.pattern, name); ok {
+			return p.buckets
+		}
+	}
+	return v.defaultBuckets
+}
 
-	key += "("
-	started := false
-	for k, _ := range m.ConstLabels {
-		if started {
-			key += ","
+// bucketPattern is a set of histogram buckets used for histograms with names matching the pattern.
+type bucketPattern struct {
+	pattern string
+	buckets []float64
+}
+
+func (v *metricVectors) getSummary(m Metric) (prometheus.Observer, error) {
+	vector, schema, err := v.ensureSummaryVector(m)
+	if err != nil {
+		return nil, err
+	}
+	l, err := v.labelsFor(m, schema)
+	if err != nil {
+		return nil, err
+	}
+	return vector.With(l), nil
+}
+
+// ensureSummaryVector returns the vector of the metric and the sorted names of the labels it was registered with,
+// registering it with the spec given by AddSummarySpec if this is the first time the metric is seen.
+func (v *metricVectors) ensureSummaryVector(m Metric) (*prometheus.SummaryVec, []string, error) {
+	if err := checkReservedLabel(m, "quantile", "summaries"); err != nil {
+		return nil, nil, err
+	}
+	if v.strictNames {
+		if err := checkNames(m); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	key := v.fqName(m)
+	v.mux.RLock()
+	vector, ok := v.summaries[key]
+	schema := v.labelSchemas[key]
+	v.mux.RUnlock()
+	if ok {
+		return vector, schema, nil
+	}
+
+	v.mux.Lock()
+	defer v.mux.Unlock()
+
+	if vector, ok := v.summaries[key]; ok {
+		return vector, v.labelSchemas[key], nil
+	}
+
+	spec := v.summarySpecs[m.toPromoMetricName()]
+	if spec.Objectives == nil {
+		spec.Objectives = defaultSummaryObjectives
+	}
+
+	opts := prometheus.SummaryOpts{
+		Namespace:  v.namespaceOf(m),
+		Subsystem:  v.subsystemOf(m),
+		Name:       m.toPromoMetricName(),
+		Help:       m.help(),
+		Objectives: spec.Objectives,
+		MaxAge:     spec.MaxAge,
+		AgeBuckets: spec.AgeBuckets,
+	}
+	schema = sortedLabelNames(m)
+	vector = prometheus.NewSummaryVec(opts, schema)
+	if err := v.registerer.Register(vector); err != nil {
+		are, ok := err.(prometheus.AlreadyRegisteredError)
+		if !ok {
+			return nil, nil, registrationError(v.fqName(m), err)
+		}
+		existing, ok := are.ExistingCollector.(*prometheus.SummaryVec)
+		if !ok {
+			return nil, nil, registrationError(v.fqName(m), err)
+		}
+		vector = existing
+	}
+	v.summaries[key] = vector
+	v.labelSchemas[key] = schema
+	return vector, schema, nil
+}
+
+func registrationError(name string, err error) error {
+	return fmt.Errorf("could not register metric %s: %w", name, err)
+}
+
+// namespaceOf returns the namespace of the metric, which is the default namespace unless the metric sets its own.
+func (v *metricVectors) namespaceOf(m Metric) string {
+	if m.Namespace != "" {
+		return promoMetricName(m.Namespace)
+	}
+	return v.namespace
+}
+
+// subsystemOf returns the subsystem of the metric, which is the default subsystem unless the metric sets its own.
+func (v *metricVectors) subsystemOf(m Metric) string {
+	if m.Subsystem != "" {
+		return promoMetricName(m.Subsystem)
+	}
+	return v.subsystem
+}
+
+// fqName is the fully qualified Prometheus name of the metric, including namespace and subsystem.
+func (v *metricVectors) fqName(m Metric) string {
+	return prometheus.BuildFQName(v.namespaceOf(m), v.subsystemOf(m), m.toPromoMetricName())
+}
+
+// labelsFor returns the labels to observe the metric with, validated against the label names the metric was
+// registered with according to the label policy.
+func (v *metricVectors) labelsFor(m Metric, schema []string) (map[string]string, error) {
+	l := labels(m)
+	known := 0
+	for _, name := range schema {
+		if _, ok := l[name]; ok {
+			known++
+		}
+	}
+	if known == len(l) && known == len(schema) {
+		return l, nil
+	}
+	if v.labelPolicy == PadMissingLabels && known == len(l) {
+		padded := make(map[string]string, len(schema))
+		for _, name := range schema {
+			padded[name] = l[name]
 		}
-		started = true
-		key += k
+		return padded, nil
 	}
-	key += ")"
+	return nil, labelMismatchError(v.fqName(m), sortedLabelNames(m), schema)
+}
 
-	return key
+func labelMismatchError(name string, labels []string, schema []string) error {
+	return fmt.Errorf("metric %s has labels %v, but was registered with labels %v", name, labels, schema)
 }
 
 func labelNames(m Metric) []string {
@@ -129,8 +400,58 @@ func labelNames(m Metric) []string {
 		return names
 	}
 	for k, _ := range m.ConstLabels {
-		names = append(names, k)
+		names = append(names, promoLabelName(k))
 	}
 	return names
 }
 
+func sortedLabelNames(m Metric) []string {
+	names := labelNames(m)
+	sort.Strings(names)
+	return names
+}
+
+// labels returns the labels of the metric with sanitized names. The labels of the metric are returned as they are
+// if all names are valid already.
+func labels(m Metric) map[string]string {
+	valid := true
+	for k := range m.ConstLabels {
+		if promoLabelName(k) != k {
+			valid = false
+			break
+		}
+	}
+	if valid {
+		return m.ConstLabels
+	}
+	l := make(map[string]string, len(m.ConstLabels))
+	for k, val := range m.ConstLabels {
+		l[promoLabelName(k)] = val
+	}
+	return l
+}
+
+// checkNames verifies that the names of the metric and its labels are valid in strict mode, i.e. that they can
+// be turned into Prometheus names by replacing spaces and hyphens only.
+func checkNames(m Metric) error {
+	if err := checkName(m.Name, true); err != nil {
+		return fmt.Errorf("invalid metric name %q: %w", m.Name, err)
+	}
+	for k := range m.ConstLabels {
+		if err := checkName(k, false); err != nil {
+			return fmt.Errorf("invalid label name %q of metric %s: %w", k, m.Name, err)
+		}
+	}
+	return nil
+}
+
+// checkReservedLabel verifies that the metric has no label with the given name, which Prometheus reserves for the
+// given kind of metrics, for instance le for the buckets of histograms.
+func checkReservedLabel(m Metric, name string, kind string) error {
+	for _, l := range labelNames(m) {
+		if l == name {
+			return fmt.Errorf("label %q of metric %s is reserved for %s", name, m.Name, kind)
+		}
+	}
+	return nil
+}
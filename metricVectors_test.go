@@ -1,9 +1,13 @@
 package telemetry
 
 import (
+	"fmt"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 )
 
 func Test_metricVectors_getCounter(t *testing.T) {
@@ -32,9 +36,9 @@ func Test_metricVectors_getCounter(t *testing.T) {
 	mv := mVectors()
 
 	// Act
-	c1 := mv.getCounter(m1)
-	c2 := mv.getCounter(m2)
-	c3 := mv.getCounter(m3)
+	c1, _ := mv.getCounter(m1)
+	c2, _ := mv.getCounter(m2)
+	c3, _ := mv.getCounter(m3)
 
 	// Assert
 	if c1 != c2 {
@@ -71,9 +75,9 @@ func Test_metricVectors_getGauge(t *testing.T) {
 	mv := mVectors()
 
 	// Act
-	c1 := mv.getGauge(m1)
-	c2 := mv.getGauge(m2)
-	c3 := mv.getGauge(m3)
+	c1, _ := mv.getGauge(m1)
+	c2, _ := mv.getGauge(m2)
+	c3, _ := mv.getGauge(m3)
 
 	// Assert
 	if c1 != c2 {
@@ -110,9 +114,9 @@ func Test_metricVectors_getHistogram(t *testing.T) {
 	mv := mVectors()
 
 	// Act
-	c1 := mv.getHistogram(m1)
-	c2 := mv.getHistogram(m2)
-	c3 := mv.getHistogram(m3)
+	c1, _ := mv.getHistogram(m1)
+	c2, _ := mv.getHistogram(m2)
+	c3, _ := mv.getHistogram(m3)
 
 	// Assert
 	if c1 != c2 {
@@ -123,11 +127,313 @@ func Test_metricVectors_getHistogram(t *testing.T) {
 	}
 }
 
+func Test_metricVectors_getSummary(t *testing.T) {
+	// Arrange
+	m1 := Metric{
+		Name:        "latency",
+		Value:       2,
+		ConstLabels: map[string]string{
+			"handler": "costs",
+		},
+	}
+	m2 := Metric{
+		Name:        "latency",
+		Value:       233,
+		ConstLabels: map[string]string{
+			"handler": "costs",
+		},
+	}
+	m3 := Metric{
+		Name:        "latency",
+		Value:       233,
+		ConstLabels: map[string]string{
+			"handler": "temps",
+		},
+	}
+	mv := mVectors()
+
+	// Act
+	c1, _ := mv.getSummary(m1)
+	c2, _ := mv.getSummary(m2)
+	c3, _ := mv.getSummary(m3)
+
+	// Assert
+	if c1 != c2 {
+		t.Error("expected same summary for handler 'costs'")
+	}
+	if c3 == c2 {
+		t.Error("expected handler 'temps' to be unequal to 'costs'")
+	}
+}
+
+func TestAddSummarySpec_defaultObjectives(t *testing.T) {
+	// Arrange
+	tm := New(Empty(), AddSummarySpec("latency", SummarySpec{MaxAge: time.Minute}))
+
+	// Act
+	tm.ObserveSummary(Metric{Name: "latency", Value: 2})
+
+	// Assert
+	body := scrapeHandler(tm.MetricsHandler())
+	for _, q := range []string{"0.5", "0.9", "0.99"} {
+		if !strings.Contains(body, `latency{quantile="`+q+`"} 2`) {
+			t.Errorf("expected the %s quantile, got %s", q, body)
+		}
+	}
+}
+
+func Test_metricVectors_bucketsFor(t *testing.T) {
+	// Arrange
+	mv := mVectors()
+	mv.histogramBucketSpecs = map[string][]float64{"http_costs_latency": {1}}
+	mv.histogramPatterns = []bucketPattern{
+		{pattern: "http_*_latency", buckets: []float64{2}},
+		{pattern: "http_*", buckets: []float64{3}},
+	}
+	mv.defaultBuckets = []float64{4}
+
+	tests := []struct {
+		name     string
+		expected float64
+	}{
+		{"http_costs_latency", 1},
+		{"http_temps_latency", 2},
+		{"http_temps_requests", 3},
+		{"latency", 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Act
+			b := mv.bucketsFor(tt.name)
+
+			// Assert
+			if len(b) != 1 || b[0] != tt.expected {
+				t.Errorf("bucketsFor() = %v, want [%v]", b, tt.expected)
+			}
+		})
+	}
+}
+
+func Test_metricVectors_registrationConflict(t *testing.T) {
+	// Arrange
+	m := Metric{
+		Name:        "cost",
+		Value:       2,
+		ConstLabels: map[string]string{
+			"cloud": "gcp",
+		},
+	}
+	mv := mVectors()
+
+	// Act
+	_, counterErr := mv.getCounter(m)
+	_, gaugeErr := mv.getGauge(m)
+
+	// Assert
+	if counterErr != nil {
+		t.Errorf("unexpected error %v", counterErr)
+	}
+	if gaugeErr == nil {
+		t.Error("expected gauge with the same name as a counter to fail")
+	}
+}
+
+func Test_metricVectors_reservedLabels(t *testing.T) {
+	// Arrange
+	mv := mVectors()
+
+	// Act
+	_, histogramErr := mv.getHistogram(Metric{Name: "latency", ConstLabels: map[string]string{"le": "x"}})
+	_, summaryErr := mv.getSummary(Metric{Name: "size", ConstLabels: map[string]string{"quantile": "x"}})
+	_, counterErr := mv.getCounter(Metric{Name: "requests", ConstLabels: map[string]string{"le": "x"}})
+
+	// Assert
+	if histogramErr == nil || histogramErr.Error() != `label "le" of metric latency is reserved for histograms` {
+		t.Errorf("expected the le label of a histogram to be rejected, got %v", histogramErr)
+	}
+	if summaryErr == nil || summaryErr.Error() != `label "quantile" of metric size is reserved for summaries` {
+		t.Errorf("expected the quantile label of a summary to be rejected, got %v", summaryErr)
+	}
+	if counterErr != nil {
+		t.Errorf("unexpected error %v", counterErr)
+	}
+}
+
+func Test_metricVectors_sharedRegistry(t *testing.T) {
+	// Arrange
+	m := Metric{
+		Name:        "cost",
+		Value:       2,
+		ConstLabels: map[string]string{
+			"cloud": "gcp",
+		},
+	}
+	mv1 := mVectors()
+	mv2 := mVectors()
+	mv2.registerer = mv1.registerer
+
+	// Act
+	c1, err1 := mv1.getCounter(m)
+	c2, err2 := mv2.getCounter(m)
+
+	// Assert
+	if err1 != nil || err2 != nil {
+		t.Errorf("unexpected errors %v, %v", err1, err2)
+	}
+	if c1 != c2 {
+		t.Error("expected the already registered counter to be reused")
+	}
+}
+
+func Test_metricVectors_labelMismatch(t *testing.T) {
+	// Arrange
+	m1 := Metric{
+		Name:        "cost",
+		Value:       2,
+		ConstLabels: map[string]string{
+			"cloud": "gcp",
+		},
+	}
+	m2 := Metric{
+		Name:        "cost",
+		Value:       2,
+		ConstLabels: map[string]string{
+			"cloud":  "gcp",
+			"region": "europe-north1",
+		},
+	}
+	m3 := Metric{
+		Name:        "cost",
+		Value:       2,
+	}
+	mv := mVectors()
+
+	// Act
+	_, err1 := mv.getCounter(m1)
+	_, err2 := mv.getCounter(m2)
+	_, err3 := mv.getCounter(m3)
+
+	// Assert
+	if err1 != nil {
+		t.Errorf("unexpected error %v", err1)
+	}
+	if err2 == nil {
+		t.Error("expected extra label to be rejected")
+	}
+	if err3 == nil {
+		t.Error("expected missing label to be rejected")
+	}
+}
+
+func Test_metricVectors_labelPadding(t *testing.T) {
+	// Arrange
+	m1 := Metric{
+		Name:        "cost",
+		Value:       2,
+		ConstLabels: map[string]string{
+			"cloud":  "gcp",
+			"region": "europe-north1",
+		},
+	}
+	m2 := Metric{
+		Name:        "cost",
+		Value:       2,
+		ConstLabels: map[string]string{
+			"cloud": "gcp",
+		},
+	}
+	m3 := Metric{
+		Name:        "cost",
+		Value:       2,
+		ConstLabels: map[string]string{
+			"zone": "a",
+		},
+	}
+	mv := mVectors()
+	mv.labelPolicy = PadMissingLabels
+
+	// Act
+	c1, err1 := mv.getCounter(m1)
+	c2, err2 := mv.getCounter(m2)
+	_, err3 := mv.getCounter(m3)
+
+	// Assert
+	if err1 != nil || err2 != nil {
+		t.Errorf("unexpected errors %v, %v", err1, err2)
+	}
+	if c1 == c2 {
+		t.Error("expected padded region to be a separate series")
+	}
+	if err3 == nil {
+		t.Error("expected unknown label to be rejected")
+	}
+}
+
+func Test_metricVectors_concurrentAccess(t *testing.T) {
+	// Arrange
+	mv := mVectors()
+	clouds := []string{"gcp", "azure", "aws"}
+	wg := &sync.WaitGroup{}
+
+	// Act
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				m := Metric{
+					Name:        fmt.Sprintf("cost %d", j%5),
+					Value:       1,
+					ConstLabels: map[string]string{
+						"cloud": clouds[(i+j)%len(clouds)],
+					},
+				}
+				c, err := mv.getCounter(m)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				c.Add(m.Value)
+
+				m.Name = fmt.Sprintf("temp %d", j%5)
+				g, err := mv.getGauge(m)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				g.Set(m.Value)
+
+				m.Name = fmt.Sprintf("latency %d", j%5)
+				h, err := mv.getHistogram(m)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				h.Observe(m.Value)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// Assert
+	c, _ := mv.getCounter(Metric{Name: "cost 0", ConstLabels: map[string]string{"cloud": "gcp"}})
+	if v := testutil.ToFloat64(c); v == 0 {
+		t.Error("expected counter to be incremented")
+	}
+	if len(mv.counters) != 5 || len(mv.gauges) != 5 || len(mv.histograms) != 5 {
+		t.Errorf("expected 5 vectors of each kind, got %d, %d, %d",
+			len(mv.counters), len(mv.gauges), len(mv.histograms))
+	}
+}
+
 func mVectors() *metricVectors {
 	return &metricVectors{
-		mux:       &sync.Mutex{},
+		mux:       &sync.RWMutex{},
+		registerer: prometheus.NewRegistry(),
 		counters:  map[string]*prometheus.CounterVec{},
 		gauges:    map[string]*prometheus.GaugeVec{},
 		histograms: map[string]*prometheus.HistogramVec{},
+		summaries: map[string]*prometheus.SummaryVec{},
+		labelSchemas: map[string][]string{},
 	}
 }
@@ -1,7 +1,9 @@
 package telemetry
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"net/http"
 	"time"
 )
@@ -12,6 +14,14 @@ type RoundTrip struct {
 	HandlerName      string
 	HTTPResponseCode int
 	Contents         []byte
+
+	// Header is added to the header of the response before it is written, for instance Content-Type, caching
+	// headers, cookies or the Location of a redirect.
+	Header http.Header
+
+	// Body is copied to the response instead of Contents if set, which lets large responses be streamed. It is
+	// closed afterwards if it is an io.Closer.
+	Body io.Reader
 }
 
 // RequestHandler the instance that is responsible for the business logic to be performed as a result of the incoming
@@ -21,48 +31,282 @@ type RequestHandler interface {
 }
 
 // Wrap the handler so that it can be presented as http.Handler. The wrapper will automatically set the correct
-// Prometheus metrics for each handled request.
-func Wrap(h RequestHandler, logChannels LogChannels) http.Handler {
-	return &wrapper{
+// Prometheus metrics for each handled request. Wrap panics if the options cannot be applied, see WithInFlightGauge.
+func Wrap(h RequestHandler, logChannels LogChannels, opts ...WrapOption) http.Handler {
+	w := &wrapper{
 		handler:     h,
 		logChannels: logChannels,
 	}
+	for _, opt := range opts {
+		opt(w)
+	}
+	w.checkInFlight("WithHandlerName")
+	return w
+}
+
+// WrapOption specifies options for configuring the wrapper created by Wrap.
+type WrapOption func(*wrapper)
+
+// WithTimeout makes the wrapper cancel the context of the request when the handler has not returned within d, and
+// respond with onTimeout instead. The HandlerName of onTimeout names the metrics the same way as for the round trips
+// returned by the handler, and its HTTPResponseCode defaults to 503 Service Unavailable, while 504 Gateway Timeout
+// may be more appropriate for handlers that mainly wait for other services. Timeouts are counted by the Prometheus
+// counter http_<handlerName>_timeouts_total, in addition to being counted as requests. NB! The handler keeps running
+// until it returns, so it should stop its work when the context of the request is done. The Body of the round trip it
+// returns late is closed, and a panic after the timeout is sent on ErrorChan. A panic before the timeout is raised
+// again with its original value, and is sent on ErrorChan with the stack trace of the handler. As onTimeout is used
+// for all requests that time out, it must not have a Body.
+func WithTimeout(d time.Duration, onTimeout RoundTrip) WrapOption {
+	return func(w *wrapper) {
+		if onTimeout.HTTPResponseCode == 0 {
+			onTimeout.HTTPResponseCode = http.StatusServiceUnavailable
+		}
+		w.timeout = d
+		w.onTimeout = onTimeout
+	}
+}
+
+// WithHandlerName sets the name of the handler up front, which is needed by WithInFlightGauge. It also names the
+// metrics of round trips that have no HandlerName.
+func WithHandlerName(name string) WrapOption {
+	return func(w *wrapper) {
+		w.handlerName = name
+	}
+}
+
+// WithMethodLabel adds the label method, holding the http method of the request, to the metrics of the handler.
+func WithMethodLabel() WrapOption {
+	return func(w *wrapper) {
+		w.metrics.methodLabel = true
+	}
+}
+
+// WithRouteLabel adds the label route, holding the given route template (for instance "/costs/{id}"), to the
+// metrics of the handler. This lets handlers that share a name be told apart without labeling by the path of each
+// request, which would make the number of label values unbounded.
+func WithRouteLabel(route string) WrapOption {
+	return func(w *wrapper) {
+		w.metrics.route = route
+	}
+}
+
+// WithStatusClassLabel replaces the label code of the metrics of the handler by the label status_class, holding the
+// class of the status code (1xx, 2xx, 3xx, 4xx or 5xx), in order to keep the number of label values low.
+func WithStatusClassLabel() WrapOption {
+	return func(w *wrapper) {
+		w.metrics.statusClass = true
+	}
+}
+
+// WithInFlightGauge maintains the Prometheus gauge http_<handlerName>_in_flight_requests, holding the number of
+// requests being handled. The gauge is increased and decreased on GaugeChan, see GaugeOperation. Wrap and Middleware
+// panic if GaugeChannel has a drop policy, or if there is no handler name, given by WithHandlerName to Wrap and by the
+// handlerName argument to Middleware.
+func WithInFlightGauge() WrapOption {
+	return func(w *wrapper) {
+		w.metrics.inFlight = true
+	}
+}
+
+// WithSizeHistograms maintains the Prometheus histograms http_<handlerName>_request_size_bytes, observing the
+// Content-Length of requests that have one, and http_<handlerName>_response_size_bytes, observing the number of
+// bytes of the response. They are labeled the same way as the other metrics of the handler. NB! The default buckets
+// are meant for latencies in seconds, so buckets should be given for instance by
+// AddHistogramBucketSpecPattern("http_*_size_bytes", ExponentialBuckets(100, 10, 6)).
+func WithSizeHistograms() WrapOption {
+	return func(w *wrapper) {
+		w.metrics.sizes = true
+	}
 }
 
 type wrapper struct {
 	handler     RequestHandler
+	handlerName string
 	logChannels LogChannels
+	timeout     time.Duration
+	onTimeout   RoundTrip
+	metrics     httpMetricOptions
+}
+
+// httpMetricOptions holds the opt-in labels and metrics of a wrapped handler.
+type httpMetricOptions struct {
+	methodLabel bool
+	route       string
+	statusClass bool
+	inFlight    bool
+	sizes       bool
+}
+
+// httpRequest describes a handled http request.
+type httpRequest struct {
+	handlerName  string
+	code         int
+	latency      float64
+	method       string
+	requestSize  int64
+	responseSize int64
 }
 
 func (w *wrapper) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	start := time.Now()
 
-	r := w.handler.Handle(req)
+	if w.metrics.inFlight {
+		w.trackInFlight(GaugeInc)
+		defer w.trackInFlight(GaugeDec)
+	}
+
+	var r RoundTrip
+	if w.timeout > 0 {
+		r = w.handleWithTimeout(req)
+	} else {
+		r = w.handler.Handle(req)
+	}
+	if r.HandlerName == "" {
+		r.HandlerName = w.handlerName
+	}
 
 	elapsed := time.Since(start)
 	latency := float64(elapsed.Milliseconds())
 
-	w.registerMetrics(r, latency)
+	written := w.writeResponse(rw, r)
 
-	rw.WriteHeader(r.HTTPResponseCode)
-	rw.Write(r.Contents)
+	w.registerMetrics(httpRequest{
+		handlerName:  r.HandlerName,
+		code:         r.HTTPResponseCode,
+		latency:      latency,
+		method:       req.Method,
+		requestSize:  req.ContentLength,
+		responseSize: written,
+	})
 }
 
-func (w *wrapper) registerMetrics(r RoundTrip, latency float64) {
-	w.logChannels.CountChan <- Metric{
-		Name:        fmt.Sprintf("http_%s_requests_total", r.HandlerName),
-		Value:       1,
-		ConstLabels: map[string]string{
-			"code": fmt.Sprintf("%d", r.HTTPResponseCode),
-		},
+// checkInFlight panics if the in-flight gauge cannot be maintained. nameSource tells where the handler name is given.
+func (w *wrapper) checkInFlight(nameSource string) {
+	if !w.metrics.inFlight {
+		return
+	}
+	if w.handlerName == "" {
+		panic("telemetry: the in-flight gauge needs a handler name given by " + nameSource)
+	}
+	if w.logChannels.gaugeDrops {
+		panic("telemetry: the in-flight gauge cannot be maintained when GaugeChannel has a drop policy")
+	}
+}
+
+func (w *wrapper) trackInFlight(op GaugeOperation) {
+	w.logChannels.GaugeChan <- Metric{
+		Name:           fmt.Sprintf("http_%s_in_flight_requests", w.handlerName),
+		Help:           fmt.Sprintf("The number of http requests being handled by %s.", w.handlerName),
+		GaugeOperation: op,
+	}
+}
+
+// handleWithTimeout lets the handler handle req on a separate go routine, returning the timeout round trip if the
+// handler does not return before the timeout. A panic in the handler is raised again with its original value on the
+// calling go routine, where it is recovered by the http server as usual. As the stack trace of the calling go routine
+// does not show where the handler panicked, the panic is sent on ErrorChan with the stack trace of the handler as
+// well. Once the timeout has expired, the late result of the handler is discarded by discardLate.
+func (w *wrapper) handleWithTimeout(req *http.Request) RoundTrip {
+	ctx, cancel := context.WithTimeout(req.Context(), w.timeout)
+	defer cancel()
+
+	handlerName := w.onTimeout.HandlerName
+	if handlerName == "" {
+		handlerName = w.handlerName
+	}
+
+	done := make(chan RoundTrip, 1)
+	panicked := make(chan handlerPanic, 1)
+	go func() {
+		defer func() {
+			if p := recover(); p != nil {
+				// The stack is still the one of the panic, skipping this function and runtime.gopanic.
+				panicked <- handlerPanic{value: p, stack: callers(2)}
+			}
+		}()
+		done <- w.handler.Handle(req.WithContext(ctx))
+	}()
+
+	select {
+	case r := <-done:
+		return r
+	case p := <-panicked:
+		// The http server aborts the response without logging this panic, so it is not reported either.
+		if p.value != http.ErrAbortHandler {
+			w.logChannels.ErrorChan <- p.error(fmt.Sprintf("handler %s panicked", handlerName))
+		}
+		panic(p.value)
+	case <-ctx.Done():
+		r := w.onTimeout
+		r.HandlerName = handlerName
+		go w.discardLate(r.HandlerName, done, panicked)
+		if req.Context().Err() != nil {
+			// The client has gone away, which is not a timeout of the handler.
+			return r
+		}
+		w.logChannels.CountChan <- Metric{
+			Name:  fmt.Sprintf("http_%s_timeouts_total", r.HandlerName),
+			Value: 1,
+			Help:  fmt.Sprintf("The total number of http requests handled by %s that timed out.", r.HandlerName),
+		}
+		return r
+	}
+}
+
+// discardLate waits for a handler that has timed out to return, closing the body of its round trip, or reports its
+// panic as an error, as there is no longer a request to raise it on.
+func (w *wrapper) discardLate(handlerName string, done <-chan RoundTrip, panicked <-chan handlerPanic) {
+	select {
+	case r := <-done:
+		if c, ok := r.Body.(io.Closer); ok {
+			c.Close()
+		}
+	case p := <-panicked:
+		w.logChannels.ErrorChan <- p.error(fmt.Sprintf("handler %s panicked after timing out", handlerName))
+	}
+}
+
+// handlerPanic is a panic recovered on the go routine of a handler, with the stack trace of that go routine.
+type handlerPanic struct {
+	value interface{}
+	stack []uintptr
+}
+
+// error returns an error with the given message and the value of the panic, holding the stack trace of the handler.
+func (p handlerPanic) error(msg string) error {
+	return &stackError{
+		err:   fmt.Errorf("%s: %v", msg, p.value),
+		stack: p.stack,
 	}
-	w.logChannels.HistogramChan <- Metric{
-		Name:        fmt.Sprintf("http_%s_latency", r.HandlerName),
-		Value:       latency,
-		ConstLabels: map[string]string{
-			"code": fmt.Sprintf("%d", r.HTTPResponseCode),
-		},
+}
+
+// writeResponse writes the header, status code and contents of r to rw, and returns the number of bytes written.
+// Failing to copy the body is reported as an error, as the status code has already been sent by then.
+func (w *wrapper) writeResponse(rw http.ResponseWriter, r RoundTrip) int64 {
+	h := rw.Header()
+	for k, vs := range r.Header {
+		for _, v := range vs {
+			h.Add(k, v)
+		}
 	}
+	rw.WriteHeader(r.HTTPResponseCode)
+
+	if r.Body == nil {
+		n, _ := rw.Write(r.Contents)
+		return int64(n)
+	}
+	if c, ok := r.Body.(io.Closer); ok {
+		defer c.Close()
+	}
+	n, err := io.Copy(rw, r.Body)
+	if err != nil {
+		w.logChannels.ErrorChan <- fmt.Errorf("writing the response of %s: %w", r.HandlerName, err)
+	}
+	return n
+}
+
+func (w *wrapper) registerMetrics(r httpRequest) {
+	registerHTTPMetrics(w.logChannels, w.metrics, r)
 	//if r.HTTPResponseCode >= 500 {
 	//	w.logChannels.CountChan <- Metric{
 	//		Name:  "http_responses_500_total",
@@ -90,4 +334,55 @@ func (w *wrapper) registerMetrics(r RoundTrip, latency float64) {
 	//	Name:  fmt.Sprintf("http_latency_%s", r.HandlerName),
 	//	Value: latency,
 	//}
-}
\ No newline at end of file
+}
+
+// registerHTTPMetrics sends the request count and latency of a single http request to the logger, as well as the
+// opt-in metrics given by o.
+func registerHTTPMetrics(logChannels LogChannels, o httpMetricOptions, r httpRequest) {
+	logChannels.CountChan <- Metric{
+		Name:        fmt.Sprintf("http_%s_requests_total", r.handlerName),
+		Value:       1,
+		Help:        fmt.Sprintf("The total number of http requests handled by %s.", r.handlerName),
+		ConstLabels: o.labels(r),
+	}
+	logChannels.HistogramChan <- Metric{
+		Name:        fmt.Sprintf("http_%s_latency", r.handlerName),
+		Value:       r.latency,
+		Help:        fmt.Sprintf("The latency in milliseconds of http requests handled by %s.", r.handlerName),
+		ConstLabels: o.labels(r),
+	}
+	if !o.sizes {
+		return
+	}
+	if r.requestSize >= 0 {
+		logChannels.HistogramChan <- Metric{
+			Name:        fmt.Sprintf("http_%s_request_size_bytes", r.handlerName),
+			Value:       float64(r.requestSize),
+			Help:        fmt.Sprintf("The size in bytes of http requests handled by %s.", r.handlerName),
+			ConstLabels: o.labels(r),
+		}
+	}
+	logChannels.HistogramChan <- Metric{
+		Name:        fmt.Sprintf("http_%s_response_size_bytes", r.handlerName),
+		Value:       float64(r.responseSize),
+		Help:        fmt.Sprintf("The size in bytes of http responses written by %s.", r.handlerName),
+		ConstLabels: o.labels(r),
+	}
+}
+
+// labels returns the labels of the metrics of r. A new map is returned on each call, as the logger may hold on to it.
+func (o httpMetricOptions) labels(r httpRequest) map[string]string {
+	l := map[string]string{}
+	if o.statusClass {
+		l["status_class"] = fmt.Sprintf("%dxx", r.code/100)
+	} else {
+		l["code"] = fmt.Sprintf("%d", r.code)
+	}
+	if o.methodLabel {
+		l["method"] = r.method
+	}
+	if o.route != "" {
+		l["route"] = o.route
+	}
+	return l
+}
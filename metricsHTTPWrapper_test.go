@@ -3,7 +3,7 @@ package telemetry
 import (
 	"context"
 	"fmt"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"strings"
@@ -14,7 +14,7 @@ import (
 func Test_wrapper_ServeHTTP(t *testing.T) {
 	// Arrange
 	handlerName := "costs"
-	expectedMetrics := `# HELP http_costs_requests_total 
+	expectedMetrics := `# HELP http_costs_requests_total The total number of http requests handled by costs.
 # TYPE http_costs_requests_total counter
 http_costs_requests_total{code="200"} 2
 http_costs_requests_total{code="500"} 1`
@@ -85,7 +85,7 @@ http_costs_latency_bucket{code="200",le="+Inf"} 2`
 	handler.ServeHTTP(rr, req)
 
 	prr := httptest.NewRecorder()
-	pHandler := promhttp.Handler()
+	pHandler := logChannels.MetricsHandler()
 	req = httptest.NewRequest("GET", "/metrics", nil)
 	pHandler.ServeHTTP(prr, req)
 
@@ -117,4 +117,330 @@ func (m *mockHandler) Handle(r *http.Request) RoundTrip {
 type roundTripTestElement struct {
 	r     RoundTrip
 	delay time.Duration
-}
\ No newline at end of file
+}
+
+func Test_wrapper_ServeHTTP_headerAndBody(t *testing.T) {
+	// Arrange
+	logChannels := Start(context.Background(), Empty())
+	body := &closingReader{Reader: strings.NewReader(`{"cost":42}`)}
+	impl := &mockHandler{
+		elements: []roundTripTestElement{
+			{
+				r: RoundTrip{
+					HandlerName:      "costs",
+					HTTPResponseCode: 201,
+					Contents:         []byte("ignored"),
+					Header: http.Header{
+						"Content-Type":  []string{"application/json"},
+						"Cache-Control": []string{"no-store"},
+					},
+					Body: body,
+				},
+			},
+		},
+	}
+	handler := Wrap(impl, logChannels)
+
+	// Act
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("POST", "/costs", nil))
+
+	// Assert
+	if rr.Code != 201 {
+		t.Errorf("expected status 201, got %d", rr.Code)
+	}
+	if ct := rr.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("expected content type application/json, got %s", ct)
+	}
+	if cc := rr.Header().Get("Cache-Control"); cc != "no-store" {
+		t.Errorf("expected cache control no-store, got %s", cc)
+	}
+	if rr.Body.String() != `{"cost":42}` {
+		t.Errorf("expected the body to be written instead of the contents, got %s", rr.Body.String())
+	}
+	if !body.closed {
+		t.Error("expected the body to be closed")
+	}
+}
+
+type closingReader struct {
+	io.Reader
+	closed bool
+}
+
+func (c *closingReader) Close() error {
+	c.closed = true
+	return nil
+}
+
+func Test_wrapper_ServeHTTP_timeout(t *testing.T) {
+	// Arrange
+	logChannels := Start(context.Background(), Empty())
+	cancelled := make(chan struct{})
+	impl := requestHandlerFunc(func(r *http.Request) RoundTrip {
+		if r.URL.Path == "/slow" {
+			<-r.Context().Done()
+			close(cancelled)
+		}
+		return RoundTrip{HandlerName: "costs", HTTPResponseCode: 200}
+	})
+	handler := Wrap(impl, logChannels, WithTimeout(50*time.Millisecond, RoundTrip{
+		HandlerName:      "costs",
+		HTTPResponseCode: http.StatusGatewayTimeout,
+		Contents:         []byte("timed out"),
+	}))
+
+	// Act
+	fast := httptest.NewRecorder()
+	handler.ServeHTTP(fast, httptest.NewRequest("GET", "/fast", nil))
+	slow := httptest.NewRecorder()
+	handler.ServeHTTP(slow, httptest.NewRequest("GET", "/slow", nil))
+	<-cancelled
+	_ = logChannels.Shutdown(context.Background())
+
+	// Assert
+	if fast.Code != 200 {
+		t.Errorf("expected status 200, got %d", fast.Code)
+	}
+	if slow.Code != http.StatusGatewayTimeout || slow.Body.String() != "timed out" {
+		t.Errorf("expected the timeout response, got %d %s", slow.Code, slow.Body.String())
+	}
+	body := scrape(logChannels)
+	expected := []string{
+		`http_costs_timeouts_total 1`,
+		`http_costs_requests_total{code="200"} 1`,
+		`http_costs_requests_total{code="504"} 1`,
+	}
+	for _, e := range expected {
+		if !strings.Contains(body, e) {
+			t.Errorf("expected body to contain %s", e)
+		}
+	}
+}
+
+func Test_wrapper_ServeHTTP_timeoutPanic(t *testing.T) {
+	// Arrange
+	logChannels := LogChannels{ErrorChan: make(chan error, 1)}
+	failure := notFoundError{}
+	impl := requestHandlerFunc(func(r *http.Request) RoundTrip {
+		panic(failure)
+	})
+	handler := Wrap(impl, logChannels, WithTimeout(time.Second, RoundTrip{HandlerName: "costs"}))
+
+	// Act
+	defer func() {
+		// Assert
+		if p := recover(); p != failure {
+			t.Errorf("expected the panic of the handler to be raised again with its original value, got %v", p)
+		}
+		err := <-logChannels.ErrorChan
+		if err.Error() != "handler costs panicked: "+failure.Error() {
+			t.Errorf("unexpected error %v", err)
+		}
+		frames := stackFrames(errorStack(err))
+		if len(frames) == 0 || frames[0].Method != "Test_wrapper_ServeHTTP_timeoutPanic.func1" {
+			t.Errorf("expected the stack of the handler, got %+v", frames)
+		}
+	}()
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+}
+
+func Test_wrapper_ServeHTTP_timeoutAbort(t *testing.T) {
+	// Arrange
+	logChannels := Start(context.Background(), Empty())
+	impl := requestHandlerFunc(func(r *http.Request) RoundTrip {
+		panic(http.ErrAbortHandler)
+	})
+	handler := Wrap(impl, logChannels, WithTimeout(time.Second, RoundTrip{HandlerName: "costs"}))
+
+	// Act
+	defer func() {
+		// Assert
+		if p := recover(); p != http.ErrAbortHandler {
+			t.Errorf("expected http.ErrAbortHandler to be raised again as is, got %v", p)
+		}
+	}()
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+}
+
+func Test_wrapper_ServeHTTP_lateResult(t *testing.T) {
+	// Arrange
+	logChannels := Start(context.Background(), Empty())
+	release := make(chan struct{})
+	body := &notifyingCloser{Reader: strings.NewReader("late"), closed: make(chan struct{})}
+	impl := requestHandlerFunc(func(r *http.Request) RoundTrip {
+		<-release
+		return RoundTrip{HandlerName: "costs", HTTPResponseCode: 200, Body: body}
+	})
+	handler := Wrap(impl, logChannels, WithTimeout(10*time.Millisecond, RoundTrip{HandlerName: "costs"}))
+
+	// Act
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	close(release)
+
+	// Assert
+	select {
+	case <-body.closed:
+	case <-time.After(time.Second):
+		t.Error("expected the body of the late round trip to be closed")
+	}
+}
+
+func Test_wrapper_ServeHTTP_latePanic(t *testing.T) {
+	// Arrange
+	logChannels := LogChannels{
+		CountChan:     make(chan Metric, 10),
+		HistogramChan: make(chan Metric, 10),
+		ErrorChan:     make(chan error),
+	}
+	release := make(chan struct{})
+	impl := requestHandlerFunc(func(r *http.Request) RoundTrip {
+		<-release
+		panic("handler failed")
+	})
+	handler := Wrap(impl, logChannels, WithTimeout(10*time.Millisecond, RoundTrip{HandlerName: "costs"}))
+
+	// Act
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	close(release)
+
+	// Assert
+	select {
+	case err := <-logChannels.ErrorChan:
+		if err.Error() != "handler costs panicked after timing out: handler failed" {
+			t.Errorf("unexpected error %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("expected the late panic to be reported")
+	}
+}
+
+type notifyingCloser struct {
+	io.Reader
+	closed chan struct{}
+}
+
+func (n *notifyingCloser) Close() error {
+	close(n.closed)
+	return nil
+}
+
+func TestWrap_inFlightGaugeMisconfigured(t *testing.T) {
+	impl := requestHandlerFunc(func(r *http.Request) RoundTrip {
+		return RoundTrip{HTTPResponseCode: 200}
+	})
+	tests := []struct {
+		name        string
+		logChannels LogChannels
+		opts        []WrapOption
+		wantPanic   string
+	}{
+		{
+			name:        "without handler name",
+			logChannels: LogChannels{},
+			opts:        []WrapOption{WithInFlightGauge()},
+			wantPanic:   "telemetry: the in-flight gauge needs a handler name given by WithHandlerName",
+		},
+		{
+			name:        "dropping gauge channel",
+			logChannels: Start(context.Background(), Empty(), WithOverflowPolicy(DropOldest)),
+			opts:        []WrapOption{WithHandlerName("costs"), WithInFlightGauge()},
+			wantPanic:   "telemetry: the in-flight gauge cannot be maintained when GaugeChannel has a drop policy",
+		},
+		{
+			name:        "dropping other channels",
+			logChannels: Start(context.Background(), Empty(), WithOverflowPolicy(DropOldest, CountChannel)),
+			opts:        []WrapOption{WithHandlerName("costs"), WithInFlightGauge()},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func() {
+				if p, _ := recover().(string); p != tt.wantPanic {
+					t.Errorf("expected panic %q, got %q", tt.wantPanic, p)
+				}
+			}()
+			Wrap(impl, tt.logChannels, tt.opts...)
+		})
+	}
+}
+
+type requestHandlerFunc func(r *http.Request) RoundTrip
+
+func (f requestHandlerFunc) Handle(r *http.Request) RoundTrip {
+	return f(r)
+}
+
+func Test_wrapper_ServeHTTP_options(t *testing.T) {
+	// Arrange
+	logChannels := Start(context.Background(), Empty())
+	var inFlight string
+	impl := requestHandlerFunc(func(r *http.Request) RoundTrip {
+		// The logger has handled the increase of the gauge once it receives the next message.
+		logChannels.DebugChan <- "handling"
+		inFlight = scrape(logChannels)
+		code := 200
+		if r.Method == "POST" {
+			code = 201
+		}
+		return RoundTrip{HTTPResponseCode: code, Contents: []byte("12345")}
+	})
+	handler := Wrap(impl, logChannels,
+		WithHandlerName("costs"),
+		WithMethodLabel(),
+		WithRouteLabel("/costs/{id}"),
+		WithStatusClassLabel(),
+		WithInFlightGauge(),
+		WithSizeHistograms())
+
+	// Act
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/costs/1", nil))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/costs/2", strings.NewReader("abc")))
+	_ = logChannels.Shutdown(context.Background())
+
+	// Assert
+	if !strings.Contains(inFlight, "http_costs_in_flight_requests 1") {
+		t.Errorf("expected a request in flight while handling, got %s", inFlight)
+	}
+	body := scrape(logChannels)
+	expected := []string{
+		`http_costs_requests_total{method="GET",route="/costs/{id}",status_class="2xx"} 1`,
+		`http_costs_requests_total{method="POST",route="/costs/{id}",status_class="2xx"} 1`,
+		`http_costs_latency_count{method="GET",route="/costs/{id}",status_class="2xx"} 1`,
+		`http_costs_request_size_bytes_sum{method="POST",route="/costs/{id}",status_class="2xx"} 3`,
+		`http_costs_response_size_bytes_sum{method="GET",route="/costs/{id}",status_class="2xx"} 5`,
+		`http_costs_in_flight_requests 0`,
+	}
+	for _, e := range expected {
+		if !strings.Contains(body, e) {
+			t.Errorf("expected body to contain %s", e)
+		}
+	}
+	if strings.Contains(body, `code="`) {
+		t.Error("did not expect the code label when the status class is used")
+	}
+}
+
+func Test_httpMetricOptions_labels(t *testing.T) {
+	tests := []struct {
+		name string
+		o    httpMetricOptions
+		want map[string]string
+	}{
+		{name: "default", o: httpMetricOptions{}, want: map[string]string{"code": "404"}},
+		{name: "status class", o: httpMetricOptions{statusClass: true}, want: map[string]string{"status_class": "4xx"}},
+		{
+			name: "method and route",
+			o:    httpMetricOptions{methodLabel: true, route: "/costs"},
+			want: map[string]string{"code": "404", "method": "GET", "route": "/costs"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.o.labels(httpRequest{code: 404, method: "GET"})
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("labels() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,140 @@
+package telemetry
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Middleware returns a func that wraps a http.Handler so that the same Prometheus metrics are maintained for it as
+// for a RequestHandler wrapped by Wrap, i.e. http_<handlerName>_requests_total and http_<handlerName>_latency
+// labeled by the status code of the response. This lets existing handlers, routers and streaming handlers be
+// instrumented without being rewritten:
+//
+//	http.Handle("/costs", telemetry.Middleware("costs", logChannels)(costsHandler))
+//
+// The options of Wrap that configure metrics apply to the middleware as well, while WithTimeout is ignored as the
+// response may already be partly written when the timeout expires.
+func Middleware(handlerName string, logChannels LogChannels, opts ...WrapOption) func(http.Handler) http.Handler {
+	w := &wrapper{
+		logChannels: logChannels,
+	}
+	for _, opt := range opts {
+		opt(w)
+	}
+	w.handlerName = handlerName
+	w.checkInFlight("the handlerName argument of Middleware")
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			start := time.Now()
+
+			if w.metrics.inFlight {
+				w.trackInFlight(GaugeInc)
+				defer w.trackInFlight(GaugeDec)
+			}
+
+			rec, recw := newResponseRecorder(rw)
+			next.ServeHTTP(recw, req)
+
+			elapsed := time.Since(start)
+			latency := float64(elapsed.Milliseconds())
+
+			w.registerMetrics(httpRequest{
+				handlerName:  handlerName,
+				code:         rec.statusCode(),
+				latency:      latency,
+				method:       req.Method,
+				requestSize:  req.ContentLength,
+				responseSize: rec.written,
+			})
+		})
+	}
+}
+
+// responseRecorder wraps a http.ResponseWriter in order to record the status code and the number of bytes written.
+type responseRecorder struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+// newResponseRecorder returns a recorder for rw, along with the writer to hand to the handler. The writer implements
+// http.Flusher and http.Hijacker only if rw does, so that streaming and websocket handlers keep working, and
+// handlers that check for these interfaces are not misled.
+func newResponseRecorder(rw http.ResponseWriter) (*responseRecorder, http.ResponseWriter) {
+	r := &responseRecorder{ResponseWriter: rw}
+	_, flusher := rw.(http.Flusher)
+	_, hijacker := rw.(http.Hijacker)
+	switch {
+	case flusher && hijacker:
+		return r, flushHijackRecorder{r}
+	case flusher:
+		return r, flushRecorder{r}
+	case hijacker:
+		return r, hijackRecorder{r}
+	default:
+		return r, r
+	}
+}
+
+// WriteHeader records the first final status code. Informational codes such as 103 Early Hints are followed by
+// another status code, except for 101 Switching Protocols.
+func (r *responseRecorder) WriteHeader(code int) {
+	informational := code >= 100 && code < 200 && code != http.StatusSwitchingProtocols
+	if r.status == 0 && !informational {
+		r.status = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *responseRecorder) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(p)
+	r.written += int64(n)
+	return n, err
+}
+
+func (r *responseRecorder) flush() {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	r.ResponseWriter.(http.Flusher).Flush()
+}
+
+func (r *responseRecorder) hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if r.status == 0 {
+		r.status = http.StatusSwitchingProtocols
+	}
+	return r.ResponseWriter.(http.Hijacker).Hijack()
+}
+
+// Unwrap returns the wrapped writer.
+func (r *responseRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+type flushRecorder struct{ *responseRecorder }
+
+func (r flushRecorder) Flush() { r.flush() }
+
+type hijackRecorder struct{ *responseRecorder }
+
+func (r hijackRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) { return r.hijack() }
+
+type flushHijackRecorder struct{ *responseRecorder }
+
+func (r flushHijackRecorder) Flush() { r.flush() }
+
+func (r flushHijackRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) { return r.hijack() }
+
+// statusCode is the status code of the response, which is 200 if the handler wrote nothing.
+func (r *responseRecorder) statusCode() int {
+	if r.status == 0 {
+		return http.StatusOK
+	}
+	return r.status
+}
@@ -0,0 +1,238 @@
+package telemetry
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMiddleware(t *testing.T) {
+	// Arrange
+	logChannels := Start(context.Background(), Empty())
+	handler := Middleware("costs", logChannels)(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/missing" {
+			http.NotFound(rw, req)
+			return
+		}
+		rw.Write([]byte("costs"))
+		rw.(http.Flusher).Flush()
+	}))
+
+	// Act
+	for _, path := range []string{"/costs", "/costs", "/missing"} {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+		if path == "/costs" && (rr.Body.String() != "costs" || !rr.Flushed) {
+			t.Errorf("expected the response to be written and flushed, got %q", rr.Body.String())
+		}
+	}
+
+	_ = logChannels.Shutdown(context.Background())
+
+	// Assert
+	body := scrape(logChannels)
+	expected := []string{
+		`http_costs_requests_total{code="200"} 2`,
+		`http_costs_requests_total{code="404"} 1`,
+		`http_costs_latency_count{code="200"} 2`,
+		`http_costs_latency_count{code="404"} 1`,
+	}
+	for _, e := range expected {
+		if !strings.Contains(body, e) {
+			t.Errorf("expected body to contain %s", e)
+		}
+	}
+}
+
+func Test_responseRecorder(t *testing.T) {
+	tests := []struct {
+		name        string
+		write       func(rw http.ResponseWriter)
+		wantStatus  int
+		wantWritten int64
+	}{
+		{
+			name:       "nothing written",
+			write:      func(rw http.ResponseWriter) {},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name: "explicit status",
+			write: func(rw http.ResponseWriter) {
+				rw.WriteHeader(http.StatusCreated)
+				rw.WriteHeader(http.StatusInternalServerError)
+				rw.Write([]byte("created"))
+			},
+			wantStatus:  http.StatusCreated,
+			wantWritten: 7,
+		},
+		{
+			name: "early hints",
+			write: func(rw http.ResponseWriter) {
+				rw.WriteHeader(http.StatusEarlyHints)
+				rw.WriteHeader(http.StatusNotFound)
+			},
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name: "switching protocols",
+			write: func(rw http.ResponseWriter) {
+				rw.WriteHeader(http.StatusSwitchingProtocols)
+			},
+			wantStatus: http.StatusSwitchingProtocols,
+		},
+		{
+			name: "implicit status",
+			write: func(rw http.ResponseWriter) {
+				rw.Write([]byte("ab"))
+				rw.Write([]byte("c"))
+			},
+			wantStatus:  http.StatusOK,
+			wantWritten: 3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec, rw := newResponseRecorder(httptest.NewRecorder())
+			tt.write(rw)
+			if rec.statusCode() != tt.wantStatus {
+				t.Errorf("expected status %d, got %d", tt.wantStatus, rec.statusCode())
+			}
+			if rec.written != tt.wantWritten {
+				t.Errorf("expected %d bytes written, got %d", tt.wantWritten, rec.written)
+			}
+		})
+	}
+}
+
+func Test_newResponseRecorder(t *testing.T) {
+	tests := []struct {
+		name         string
+		rw           http.ResponseWriter
+		wantFlusher  bool
+		wantHijacker bool
+	}{
+		{
+			name: "plain writer",
+			rw:   struct{ http.ResponseWriter }{httptest.NewRecorder()},
+		},
+		{
+			name:        "flusher",
+			rw:          httptest.NewRecorder(),
+			wantFlusher: true,
+		},
+		{
+			name:         "hijacker",
+			rw:           hijackingWriter{httptest.NewRecorder()},
+			wantHijacker: true,
+		},
+		{
+			name:         "flusher and hijacker",
+			rw:           flushingHijackingWriter{httptest.NewRecorder()},
+			wantFlusher:  true,
+			wantHijacker: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, rw := newResponseRecorder(tt.rw)
+			if _, ok := rw.(http.Flusher); ok != tt.wantFlusher {
+				t.Errorf("expected http.Flusher to be implemented: %v", tt.wantFlusher)
+			}
+			if _, ok := rw.(http.Hijacker); ok != tt.wantHijacker {
+				t.Errorf("expected http.Hijacker to be implemented: %v", tt.wantHijacker)
+			}
+		})
+	}
+}
+
+func Test_responseRecorder_hijack(t *testing.T) {
+	// Arrange
+	rec, rw := newResponseRecorder(hijackingWriter{httptest.NewRecorder()})
+
+	// Act
+	_, _, err := rw.(http.Hijacker).Hijack()
+
+	// Assert
+	if err != errHijacked {
+		t.Errorf("expected the wrapped writer to be hijacked, got %v", err)
+	}
+	if rec.statusCode() != http.StatusSwitchingProtocols {
+		t.Errorf("expected status %d, got %d", http.StatusSwitchingProtocols, rec.statusCode())
+	}
+}
+
+func TestMiddleware_inFlightGaugeMisconfigured(t *testing.T) {
+	tests := []struct {
+		name        string
+		handlerName string
+		logChannels LogChannels
+		wantPanic   string
+	}{
+		{
+			name:        "without handler name",
+			logChannels: LogChannels{},
+			wantPanic:   "telemetry: the in-flight gauge needs a handler name given by the handlerName argument of Middleware",
+		},
+		{
+			name:        "dropping gauge channel",
+			handlerName: "costs",
+			logChannels: Start(context.Background(), Empty(), WithOverflowPolicy(DropNewest, GaugeChannel)),
+			wantPanic:   "telemetry: the in-flight gauge cannot be maintained when GaugeChannel has a drop policy",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func() {
+				if p, _ := recover().(string); p != tt.wantPanic {
+					t.Errorf("expected panic %q, got %q", tt.wantPanic, p)
+				}
+			}()
+			Middleware(tt.handlerName, tt.logChannels, WithHandlerName("ignored"), WithInFlightGauge())
+		})
+	}
+}
+
+func TestMiddleware_options(t *testing.T) {
+	// Arrange
+	logChannels := Start(context.Background(), Empty())
+	handler := Middleware("costs", logChannels, WithMethodLabel(), WithSizeHistograms())(
+		http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			rw.Write([]byte("costs"))
+		}))
+
+	// Act
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/costs", nil))
+	_ = logChannels.Shutdown(context.Background())
+
+	// Assert
+	body := scrape(logChannels)
+	expected := []string{
+		`http_costs_requests_total{code="200",method="GET"} 1`,
+		`http_costs_response_size_bytes_sum{code="200",method="GET"} 5`,
+	}
+	for _, e := range expected {
+		if !strings.Contains(body, e) {
+			t.Errorf("expected body to contain %s", e)
+		}
+	}
+}
+
+var errHijacked = errors.New("hijacked")
+
+type hijackingWriter struct{ http.ResponseWriter }
+
+func (h hijackingWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return nil, nil, errHijacked
+}
+
+type flushingHijackingWriter struct{ *httptest.ResponseRecorder }
+
+func (h flushingHijackingWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return nil, nil, errHijacked
+}
@@ -1,8 +1,13 @@
 package telemetry
 
 import (
+	"errors"
 	"github.com/3lvia/hn-config-lib-go/vault"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 	"io"
+	"strings"
+	"time"
 )
 
 // Option specifies options for configuring the logging.
@@ -16,10 +21,28 @@ type OptionsCollector struct {
 	sendMetricsToAppInsights bool
 	empty                    bool
 	histogramBucketSpecs     map[string][]float64
+	histogramPatterns        []bucketPattern
+	defaultBuckets           []float64
+	summarySpecs             map[string]SummarySpec
+	aggregationInterval      time.Duration
+	aggregateMetrics         bool
 	v                        vault.SecretsManager
 	instrumentationKey       string
 	capture                  EventCapture
 	writer                   io.Writer
+	shutdownTimeout          time.Duration
+	discardPeriod            time.Duration
+	bufferSize               int
+	overflowPolicies         map[Channel]OverflowPolicy
+	registerer               prometheus.Registerer
+	gatherer                 prometheus.Gatherer
+	namedAsNamespace         bool
+	strictNames              bool
+	labelPolicy              LabelPolicy
+	minLevel                 Level
+	formatter                Formatter
+	errorMetricName          string
+	errorClassifier          func(error) string
 }
 
 // WithWriter lets clients set a writer which will receive logging events (in addition to the events being written
@@ -30,6 +53,14 @@ func WithWriter(w io.Writer) Option {
 	}
 }
 
+// WithFormatter sets the formatter of the entries written to the writer given by WithWriter. TextFormatter is used
+// by default, while JSONFormatter and LogfmtFormatter write lines that are easily parsed by log shippers.
+func WithFormatter(f Formatter) Option {
+	return func(collector *OptionsCollector) {
+		collector.formatter = f
+	}
+}
+
 // Named lets clients set the name of the system and application. This value will be included in all logs.
 func Named(systemName string, app string) Option {
 	return func(collector *OptionsCollector) {
@@ -55,7 +86,8 @@ func WithAppInsightsInstrumentationKey(instrumentationKey string) Option {
 }
 
 // SendMetricsToAppInsights will send metrics to Application Insights (as well as registering it as a Prometheus
-// metric.
+// metric. Histogram and summary observations are aggregated and sent once per aggregation interval, see
+// WithAppInsightsAggregationInterval.
 func SendMetricsToAppInsights() Option {
 	return func(collector *OptionsCollector) {
 		collector.sendMetricsToAppInsights = true
@@ -86,4 +118,197 @@ func AddHistogramBucketSpec(name string, buckets[]float64) Option {
 		}
 		c.histogramBucketSpecs[name] = buckets
 	}
-}
\ No newline at end of file
+}
+
+// AddHistogramBucketSpecPattern is used to specify which Prometheus histogram buckets to use for all histograms with
+// names matching the given pattern, for instance "http_*_latency". The pattern is matched against the transformed
+// Prometheus name, without namespace and subsystem, using the syntax of path.Match. Specs given by
+// AddHistogramBucketSpec take precedence, and if several patterns match, the first one given is used.
+func AddHistogramBucketSpecPattern(pattern string, buckets []float64) Option {
+	return func(c *OptionsCollector) {
+		c.histogramPatterns = append(c.histogramPatterns, bucketPattern{
+			pattern: strings.ToLower(pattern),
+			buckets: buckets,
+		})
+	}
+}
+
+// WithDefaultHistogramBuckets sets the buckets used for histograms that are not given buckets otherwise. If not set,
+// the Prometheus default buckets are used, which are tuned for latencies measured in seconds.
+func WithDefaultHistogramBuckets(buckets []float64) Option {
+	return func(c *OptionsCollector) {
+		c.defaultBuckets = buckets
+	}
+}
+
+// LinearBuckets returns count buckets, each width wide, where the upper bound of the lowest bucket is start. Panics
+// if count is less than 1.
+func LinearBuckets(start, width float64, count int) []float64 {
+	return prometheus.LinearBuckets(start, width, count)
+}
+
+// ExponentialBuckets returns count buckets, where the upper bound of the lowest bucket is start and the upper bound
+// of each of the other buckets is factor times the upper bound of the previous bucket. Useful for latencies, for
+// instance ExponentialBuckets(5, 2, 12) covers 5 ms to about 10 seconds. Panics if count is less than 1, if start is
+// not positive or if factor is not greater than 1.
+func ExponentialBuckets(start, factor float64, count int) []float64 {
+	return prometheus.ExponentialBuckets(start, factor, count)
+}
+
+// WithShutdownTimeout sets the maximum time the logger waits for queued Application Insights telemetry to be
+// delivered when it is stopped. The default is 5 seconds.
+func WithShutdownTimeout(d time.Duration) Option {
+	return func(c *OptionsCollector) {
+		c.shutdownTimeout = d
+	}
+}
+
+// WithDiscardPeriod sets how long the logger keeps receiving and discarding the telemetry sent on the channels after
+// it has stopped, so that senders such as http handlers that are still running during a graceful shutdown do not
+// block. The default is 30 seconds. Telemetry sent after this period blocks the sender, as before the logger was
+// started. Negative periods are treated as 0.
+func WithDiscardPeriod(d time.Duration) Option {
+	return func(c *OptionsCollector) {
+		if d < 0 {
+			d = 0
+		}
+		c.discardPeriod = d
+	}
+}
+
+// WithBufferSize sets the number of telemetry messages each of the channels in LogChannels can hold before the
+// overflow policy of the channel applies. The default is 0, i.e. unbuffered channels. Negative sizes are treated as 0.
+func WithBufferSize(n int) Option {
+	return func(c *OptionsCollector) {
+		if n < 0 {
+			n = 0
+		}
+		c.bufferSize = n
+	}
+}
+
+// WithOverflowPolicy sets the policy used when the buffer of the given channels is full. If no channels are given
+// the policy applies to all channels. Telemetry discarded by the policy is counted by the Prometheus counter
+// telemetry_dropped_total, labeled by channel. NB! GaugeChannel should not have a drop policy if gauges are changed
+// relative to their current value, for instance by GaugeInc and GaugeDec, as those are not repaired by later
+// telemetry the way GaugeSet is.
+func WithOverflowPolicy(policy OverflowPolicy, channels ...Channel) Option {
+	return func(c *OptionsCollector) {
+		if c.overflowPolicies == nil {
+			c.overflowPolicies = map[Channel]OverflowPolicy{}
+		}
+		if len(channels) == 0 {
+			channels = allChannels
+		}
+		for _, ch := range channels {
+			c.overflowPolicies[ch] = policy
+		}
+	}
+}
+
+// WithPrometheusRegistry sets the registry that Prometheus metrics are registered with and gathered from. By
+// default each call to Start creates its own private registry. Pass prometheus.DefaultRegisterer and
+// prometheus.DefaultGatherer in order to use the global Prometheus registry. If g is nil, the metrics are gathered
+// from r, which must then be a prometheus.Gatherer as well, or the metrics handler responds with an error.
+func WithPrometheusRegistry(r prometheus.Registerer, g prometheus.Gatherer) Option {
+	return func(c *OptionsCollector) {
+		if g == nil {
+			g = gathererOf(r)
+		}
+		c.registerer = r
+		c.gatherer = g
+	}
+}
+
+// gathererOf returns r as a gatherer, or a gatherer that fails if r is not one.
+func gathererOf(r prometheus.Registerer) prometheus.Gatherer {
+	if g, ok := r.(prometheus.Gatherer); ok {
+		return g
+	}
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		return nil, errors.New("no gatherer was given by WithPrometheusRegistry, and the registerer is not one")
+	})
+}
+
+// NamedAsNamespace makes the system and application names given to Named the default Prometheus namespace and
+// subsystem of all metrics, so that for instance the metric "cost" becomes "monitoring_cost_monitor_cost" when
+// Named("monitoring", "cost-monitor") is used. Metrics may override this by setting Namespace and Subsystem.
+func NamedAsNamespace() Option {
+	return func(c *OptionsCollector) {
+		c.namedAsNamespace = true
+	}
+}
+
+// WithStrictNames makes the logger reject metrics whose names or label names cannot be turned into valid Prometheus
+// names by replacing spaces and hyphens only. Rejected metrics are reported as errors. By default invalid characters
+// are replaced, so that for instance "Cost (NOK)/day" becomes "cost_nok_day".
+func WithStrictNames() Option {
+	return func(c *OptionsCollector) {
+		c.strictNames = true
+	}
+}
+
+// WithLabelPolicy sets the policy used when a metric is sent with other label names than the ones the metric with
+// the same name was first sent with. The default is RejectMismatchedLabels.
+func WithLabelPolicy(p LabelPolicy) Option {
+	return func(c *OptionsCollector) {
+		c.labelPolicy = p
+	}
+}
+
+// AddSummarySpec is used to specify the quantiles, max age and age buckets of the Prometheus summary with the given
+// name. NB! Must be invoked before a summary event of that name is ever raised.
+func AddSummarySpec(name string, spec SummarySpec) Option {
+	return func(c *OptionsCollector) {
+		if c.summarySpecs == nil {
+			c.summarySpecs = map[string]SummarySpec{}
+		}
+		c.summarySpecs[name] = spec
+	}
+}
+
+// WithAppInsightsAggregationInterval sets the interval at which aggregated metrics are sent to Application Insights
+// when SendMetricsToAppInsights is used. The default is one minute. NB! The aggregates are sent from a separate go
+// routine, so a capture given by WithCapture must be safe for concurrent use.
+func WithAppInsightsAggregationInterval(d time.Duration) Option {
+	return func(c *OptionsCollector) {
+		c.aggregationInterval = d
+	}
+}
+
+// AggregateMetricsInAppInsights makes counters and gauges sent to Application Insights (when SendMetricsToAppInsights
+// is used) aggregated per name and label set, and sent once per aggregation interval like histograms, instead of as
+// one telemetry item per update. The aggregate of a counter holds the increments within the interval, while the
+// aggregate of a gauge holds the values the gauge was set to. Prometheus is updated immediately regardless.
+func AggregateMetricsInAppInsights() Option {
+	return func(c *OptionsCollector) {
+		c.aggregateMetrics = true
+	}
+}
+
+// WithMinimumLevel makes the logger discard trace messages with a level below l, as well as debug messages unless l
+// is LevelDebug. The default is LevelDebug, i.e. nothing is discarded. Use ParseLevel to read the level from
+// configuration.
+func WithMinimumLevel(l Level) Option {
+	return func(c *OptionsCollector) {
+		c.minLevel = l
+	}
+}
+
+// WithErrorMetricName sets the name of the Prometheus counter that counts the errors reported, labeled by their
+// class. The default is errors_total.
+func WithErrorMetricName(name string) Option {
+	return func(c *OptionsCollector) {
+		c.errorMetricName = name
+	}
+}
+
+// WithErrorClassifier sets the func that decides the class label of the error metric. By default the class is the
+// type of the first error in the chain of wrapped errors that is not created by fmt.Errorf or by this package, for
+// instance "net.OpError". NB! The number of classes should be small, so the class must not contain variable data
+// such as the message of the error.
+func WithErrorClassifier(f func(err error) string) Option {
+	return func(c *OptionsCollector) {
+		c.errorClassifier = f
+	}
+}
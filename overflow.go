@@ -0,0 +1,110 @@
+package telemetry
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	"reflect"
+)
+
+// OverflowPolicy decides what happens when telemetry is sent on a channel whose buffer is full.
+type OverflowPolicy int
+
+const (
+	// Block makes the sender wait until there is room in the buffer. This is the default policy.
+	Block OverflowPolicy = iota
+
+	// DropNewest discards the telemetry that is being sent when the buffer is full.
+	DropNewest
+
+	// DropOldest discards the oldest telemetry in the buffer in order to make room for the telemetry that is
+	// being sent.
+	DropOldest
+)
+
+// Channel identifies one of the channels in LogChannels.
+type Channel string
+
+const (
+	CountChannel      Channel = "count"
+	GaugeChannel      Channel = "gauge"
+	HistogramChannel  Channel = "histogram"
+	SummaryChannel    Channel = "summary"
+	ErrorChannel      Channel = "error"
+	EventChannel      Channel = "event"
+	DebugChannel      Channel = "debug"
+	TraceChannel      Channel = "trace"
+	DependencyChannel Channel = "dependency"
+)
+
+var allChannels = []Channel{
+	CountChannel,
+	GaugeChannel,
+	HistogramChannel,
+	SummaryChannel,
+	ErrorChannel,
+	EventChannel,
+	DebugChannel,
+	TraceChannel,
+	DependencyChannel,
+}
+
+const (
+	droppedMetricName = "telemetry_dropped_total"
+	droppedMetricHelp = "The total number of telemetry items discarded by the overflow policy, by channel."
+)
+
+// overflow holds the buffering configuration of a single channel. When the policy is anything but Block, the
+// channel handed out to clients is drained by a forwarder that moves the telemetry to a buffered queue read by
+// the logger, applying the policy when that queue is full.
+type overflow struct {
+	size    int
+	policy  OverflowPolicy
+	dropped prometheus.Counter
+}
+
+func (o overflow) forwarding() bool {
+	return o.policy != Block
+}
+
+// clientBufferSize is the buffer size of the channel that is handed out to clients.
+func (o overflow) clientBufferSize() int {
+	if o.forwarding() {
+		return 0
+	}
+	return o.size
+}
+
+// queueSize is the buffer size of the queue read by the logger when forwarding. A drop policy needs room for at
+// least one element, or it would never be able to make progress without a receiver waiting.
+func (o overflow) queueSize() int {
+	if o.size < 1 {
+		return 1
+	}
+	return o.size
+}
+
+// forward moves the telemetry sent on in, the channel handed out to clients, to out, the queue read by the logger,
+// applying the policy when out is full. in and out are channels of the same element type, which lets one forwarder
+// serve all the channels in LogChannels. It returns when ctx is done.
+func forward(ctx context.Context, in, out interface{}, o overflow) {
+	cases := []reflect.SelectCase{
+		{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ctx.Done())},
+		{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(in)},
+	}
+	q := reflect.ValueOf(out)
+	for {
+		chosen, v, _ := reflect.Select(cases)
+		if chosen == 0 {
+			return
+		}
+		for !q.TrySend(v) {
+			if o.policy != DropOldest {
+				o.dropped.Inc()
+				break
+			}
+			if _, ok := q.TryRecv(); ok {
+				o.dropped.Inc()
+			}
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package telemetry
+
+import (
+	"context"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"testing"
+	"time"
+)
+
+func Test_forward(t *testing.T) {
+	tests := []struct {
+		policy OverflowPolicy
+		kept   string
+	}{
+		{policy: DropNewest, kept: "first"},
+		{policy: DropOldest, kept: "third"},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.policy), func(t *testing.T) {
+			// Arrange
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			dropped := prometheus.NewCounter(prometheus.CounterOpts{Name: "dropped"})
+			in := make(chan Event)
+			out := make(chan Event, 1)
+			go forward(ctx, in, out, overflow{size: 1, policy: tt.policy, dropped: dropped})
+
+			// Act
+			in <- Event{Name: "first"}
+			in <- Event{Name: "second"}
+			in <- Event{Name: "third"}
+
+			// Assert
+			waitForCount(t, dropped, 2)
+			if e := <-out; e.Name != tt.kept {
+				t.Errorf("expected %s event to be kept, got %s", tt.kept, e.Name)
+			}
+		})
+	}
+}
+
+func Test_logger_queue(t *testing.T) {
+	// Arrange
+	l := &logger{overflows: map[Channel]overflow{
+		CountChannel: {size: 2, policy: Block},
+		TraceChannel: {size: 2, policy: DropOldest, dropped: prometheus.NewCounter(prometheus.CounterOpts{Name: "d"})},
+	}}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	counts := make(chan Metric, 2)
+	traces := make(chan Trace)
+
+	// Act
+	countQueue := l.queue(ctx, CountChannel, counts).(chan Metric)
+	traceQueue := l.queue(ctx, TraceChannel, traces).(chan Trace)
+	traces <- Trace{Message: "forwarded"}
+
+	// Assert
+	if countQueue != counts {
+		t.Error("expected a blocking channel to be read directly")
+	}
+	if cap(traceQueue) != 2 {
+		t.Errorf("expected a queue of size 2, got %d", cap(traceQueue))
+	}
+	if tr := <-traceQueue; tr.Message != "forwarded" {
+		t.Errorf("expected the trace to be forwarded, got %s", tr.Message)
+	}
+}
+
+func TestStart_shutdownWhileForwarding(t *testing.T) {
+	// Arrange
+	const sent = 1000
+	logChannels := Start(context.Background(), Empty(), WithBufferSize(10), WithOverflowPolicy(DropNewest, CountChannel))
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < sent; i++ {
+			logChannels.CountChan <- Metric{Name: "sent", Value: 1}
+		}
+		// The previous messages have been handled or discarded once the next one is received.
+		logChannels.DebugChan <- "sent"
+		close(done)
+	}()
+
+	// Act
+	_ = logChannels.Shutdown(context.Background())
+	<-done
+
+	// Assert
+	families, err := logChannels.gatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var total float64
+	for _, f := range families {
+		for _, m := range f.GetMetric() {
+			switch {
+			case f.GetName() == "sent":
+				total += m.GetCounter().GetValue()
+			case f.GetName() == droppedMetricName && m.GetLabel()[0].GetValue() == string(CountChannel):
+				total += m.GetCounter().GetValue()
+			}
+		}
+	}
+	if total != sent {
+		t.Errorf("expected every message to be either handled or dropped, got %v of %d", total, sent)
+	}
+}
+
+func TestStart_bufferedChannels(t *testing.T) {
+	// Arrange
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	logChannels := Start(ctx, Empty(), WithBufferSize(3))
+
+	// Act
+	sent := make(chan struct{})
+	go func() {
+		logChannels.DebugChan <- "1"
+		logChannels.DebugChan <- "2"
+		logChannels.DebugChan <- "3"
+		close(sent)
+	}()
+
+	// Assert
+	select {
+	case <-sent:
+	case <-time.After(time.Second):
+		t.Error("expected sends on a buffered channel to complete")
+	}
+	if cap(logChannels.DebugChan) != 3 {
+		t.Errorf("expected buffer size 3, got %d", cap(logChannels.DebugChan))
+	}
+}
+
+func waitForCount(t *testing.T, c prometheus.Counter, expected float64) {
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if testutil.ToFloat64(c) == expected {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Errorf("expected count %v, got %v", expected, testutil.ToFloat64(c))
+}
+
+func TestWithBufferSize_negative(t *testing.T) {
+	// Act
+	logChannels := Start(context.Background(), Empty(), WithBufferSize(-1))
+
+	// Assert
+	if cap(logChannels.CountChan) != 0 {
+		t.Errorf("expected an unbuffered channel, got %d", cap(logChannels.CountChan))
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"github.com/3lvia/hn-config-lib-go/vault"
 	"github.com/microsoft/ApplicationInsights-Go/appinsights"
 	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 	"io"
 	"sync"
 	"time"
@@ -17,11 +18,17 @@ const (
 
 type sink interface {
 	logEvent(name string, data map[string]string)
-	error(err error)
+	error(err error, stack []uintptr)
 	debug(d string)
+	trace(t Trace)
+	dependency(d Dependency)
 	handleCounter(m Metric)
 	handleGauge(m Metric)
 	handleHistogram(m Metric)
+	handleSummary(m Metric)
+	close(timeout time.Duration)
+	selfCounter(m Metric) prometheus.Counter
+	metrics() *metricVectors
 }
 
 func newSink(collector *OptionsCollector) sink {
@@ -32,12 +39,30 @@ func newSink(collector *OptionsCollector) sink {
 		}
 	}
 
+	sss := map[string]SummarySpec{}
+	for k, v := range collector.summarySpecs {
+		sss[promoMetricName(k)] = v
+	}
+
 	m := &metricVectors{
-		mux:                  &sync.Mutex{},
+		mux:                  &sync.RWMutex{},
+		registerer:           collector.registerer,
 		counters:             map[string]*prometheus.CounterVec{},
 		gauges:               map[string]*prometheus.GaugeVec{},
 		histograms:           map[string]*prometheus.HistogramVec{},
 		histogramBucketSpecs: hbs,
+		histogramPatterns:    collector.histogramPatterns,
+		defaultBuckets:       collector.defaultBuckets,
+		summaries:            map[string]*prometheus.SummaryVec{},
+		summarySpecs:         sss,
+		labelSchemas:         map[string][]string{},
+		labelPolicy:          collector.labelPolicy,
+	}
+
+	m.strictNames = collector.strictNames
+	if collector.namedAsNamespace {
+		m.namespace = promoMetricName(collector.systemName)
+		m.subsystem = promoMetricName(collector.appName)
 	}
 
 	logInfo := map[string]string{}
@@ -51,10 +76,29 @@ func newSink(collector *OptionsCollector) sink {
 	s :=  &standardSink{
 		m:                        m,
 		sendMetricsToAppInsights: collector.sendMetricsToAppInsights,
+		aggregateMetrics:         collector.aggregateMetrics,
 		appInsightsSecretPath:    collector.appInsightsSecretPath,
 		writer:                   collector.writer,
 		capture:                  collector.capture,
 		logInfo:                  logInfo,
+		minLevel:                 collector.minLevel,
+		formatter:                collector.formatter,
+		systemName:               collector.systemName,
+		appName:                  collector.appName,
+		errorMetricName:          collector.errorMetricName,
+		errorClassifier:          collector.errorClassifier,
+	}
+	if s.errorMetricName == "" {
+		s.errorMetricName = defaultErrorMetricName
+	}
+	if s.errorClassifier == nil {
+		s.errorClassifier = defaultErrorClass
+	}
+	if s.formatter == nil {
+		s.formatter = TextFormatter()
+	}
+	if collector.sendMetricsToAppInsights {
+		s.aggregator = newMetricAggregator(collector.aggregationInterval, s.trackAggregate)
 	}
 	if collector.instrumentationKey != "" {
 		s.setInstrumentationKey(collector.instrumentationKey)
@@ -68,22 +112,37 @@ func newSink(collector *OptionsCollector) sink {
 type standardSink struct {
 	appInsightsSecretPath    string
 	sendMetricsToAppInsights bool
+	aggregateMetrics         bool
 	capture                  EventCapture
 	client                   appinsights.TelemetryClient
 	logInfo                  map[string]string
 	m                        *metricVectors
 	writer                   io.Writer
+	writerMux                sync.Mutex
+	closeOnce                sync.Once
+	closedMux                sync.RWMutex
+	closed                   bool
+	aggregator               *metricAggregator
+	minLevel                 Level
+	formatter                Formatter
+	systemName               string
+	appName                  string
+	errorMetricName          string
+	errorClassifier          func(error) string
 }
 
 func (s *standardSink) logEvent(name string, data map[string]string) {
 	event := appinsights.NewEventTelemetry(name)
 	d := s.merge(data)
 	event.Properties = d
-	if s.client != nil {
-		s.client.Track(event)
-	}
+	s.track(event)
 	if s.writer != nil {
-		s.writer.Write([]byte(fmt.Sprintf("%s  EVENT(%s) %v\n", time.Now().Format("2006-01-02 15:04:05"), name, d)))
+		s.writeEntry(LogEntry{
+			Kind:       KindEvent,
+			Name:       name,
+			Level:      LevelInfo,
+			Properties: data,
+		})
 	}
 	if s.capture != nil {
 		ce := &CapturedEvent{
@@ -95,12 +154,30 @@ func (s *standardSink) logEvent(name string, data map[string]string) {
 	}
 }
 
-func (s *standardSink) error(err error) {
+// error reports err with the stack trace held by its chain of wrapped errors, or else with stack if given.
+func (s *standardSink) error(err error, stack []uintptr) {
+	if err == nil {
+		return
+	}
+	if st := errorStack(err); st != nil {
+		stack = st
+	}
+	s.countError(err)
+	details := errorDetails(err)
+	severity := errorSeverity(err)
 	if s.client != nil {
-		s.client.TrackException(err)
+		exception := s.exception(err, details, stack)
+		exception.SeverityLevel = severity.severity()
+		s.track(exception)
 	}
 	if s.writer != nil {
-		s.writer.Write([]byte(fmt.Sprintf("%v\n", err)))
+		s.writeEntry(LogEntry{
+			Kind:       KindError,
+			Level:      severity,
+			Message:    err.Error(),
+			Properties: details,
+			Stack:      formatStack(stack),
+		})
 	}
 	if s.capture != nil {
 		ce := &CapturedEvent{
@@ -112,24 +189,99 @@ func (s *standardSink) error(err error) {
 	}
 }
 
+// countError increases the error metric, labeled by the class of err. Failing to do so is not reported as an error,
+// as that would be counted in turn, but written to the writer only.
+func (s *standardSink) countError(err error) {
+	c, cerr := s.m.getCounter(Metric{
+		Name:        s.errorMetricName,
+		Help:        "The total number of errors reported, by class.",
+		ConstLabels: map[string]string{"class": s.errorClassifier(err)},
+	})
+	if cerr != nil {
+		if s.writer != nil {
+			s.writeEntry(LogEntry{
+				Kind:    KindError,
+				Level:   LevelError,
+				Message: fmt.Sprintf("cannot count error: %v", cerr),
+			})
+		}
+		return
+	}
+	c.Inc()
+}
+
+// exception creates the Application Insights exception for err, with the given details and the global log info as
+// properties. The exception has no stack trace unless stack is given, as the current stack would be the one of the
+// logger rather than the one where the error occurred. The type of the exception is the one of the first error in the
+// chain that is not a wrapper, see exceptionError.
+func (s *standardSink) exception(err error, details map[string]string, stack []uintptr) *appinsights.ExceptionTelemetry {
+	exception := appinsights.NewExceptionTelemetry(exceptionError(err))
+	exception.Frames = nil
+	if stack != nil {
+		exception.Frames = stackFrames(stack)
+	}
+	exception.Properties = s.merge(details)
+	return exception
+}
+
 func (s *standardSink) debug(d string) {
+	if s.minLevel > LevelDebug {
+		return
+	}
 	if s.writer != nil {
-		out := fmt.Sprintf("%s\n", d)
-		s.writer.Write([]byte(out))
+		s.writeEntry(LogEntry{
+			Kind:    KindDebug,
+			Level:   LevelDebug,
+			Message: d,
+		})
+	}
+}
+
+func (s *standardSink) trace(t Trace) {
+	if t.Level < s.minLevel {
+		return
+	}
+	trace := appinsights.NewTraceTelemetry(t.Message, t.Level.severity())
+	d := s.merge(t.Fields)
+	trace.Properties = d
+	s.track(trace)
+	if s.writer != nil {
+		s.writeEntry(LogEntry{
+			Kind:       KindTrace,
+			Level:      t.Level,
+			Message:    t.Message,
+			Properties: t.Fields,
+		})
+	}
+	if s.capture != nil {
+		ce := &CapturedEvent{
+			SinkType: logTypeAppInsights,
+			Type:     "Trace",
+			Event:    trace,
+		}
+		s.capture.Capture(ce)
 	}
 }
 
 func (s *standardSink) handleCounter(m Metric) {
 	if m.Value < 0 {
-		fmt.Printf("counter %s cannot decrease, value: %v\n", m.Name, m.Value)
+		s.error(fmt.Errorf("counter %s cannot decrease, value: %v", m.Name, m.Value), nil)
 		return
 	}
 
-	c := s.m.getCounter(m)
+	c, err := s.m.getCounter(m)
+	if err != nil {
+		s.error(err, nil)
+		return
+	}
 	c.Add(m.Value)
 
 	if s.sendMetricsToAppInsights {
-		s.logMetric(m)
+		if s.aggregateMetrics {
+			s.aggregate(m)
+		} else {
+			s.logMetric(m)
+		}
 	}
 
 	if s.capture != nil {
@@ -143,11 +295,35 @@ func (s *standardSink) handleCounter(m Metric) {
 }
 
 func (s *standardSink) handleGauge(m Metric) {
-	g := s.m.getGauge(m)
-	g.Set(m.Value)
+	g, err := s.m.getGauge(m)
+	if err != nil {
+		s.error(err, nil)
+		return
+	}
+	switch m.GaugeOperation {
+	case GaugeAdd:
+		g.Add(m.Value)
+	case GaugeSub:
+		g.Sub(m.Value)
+	case GaugeInc:
+		g.Inc()
+	case GaugeDec:
+		g.Dec()
+	case GaugeSetToCurrentTime:
+		g.SetToCurrentTime()
+	default:
+		g.Set(m.Value)
+	}
 
 	if s.sendMetricsToAppInsights {
-		s.logMetric(m)
+		if m.GaugeOperation != GaugeSet {
+			m.Value = gaugeValue(g)
+		}
+		if s.aggregateMetrics {
+			s.aggregate(m)
+		} else {
+			s.logMetric(m)
+		}
 	}
 
 	if s.capture != nil {
@@ -160,10 +336,28 @@ func (s *standardSink) handleGauge(m Metric) {
 	}
 }
 
+// gaugeValue reads the current value of the gauge, which is what is sent to Application Insights when the gauge
+// is changed relative to its previous value.
+func gaugeValue(g prometheus.Gauge) float64 {
+	d := &dto.Metric{}
+	if err := g.Write(d); err != nil {
+		return 0
+	}
+	return d.GetGauge().GetValue()
+}
+
 func (s *standardSink) handleHistogram(m Metric) {
-	h := s.m.getHistogram(m)
+	h, err := s.m.getHistogram(m)
+	if err != nil {
+		s.error(err, nil)
+		return
+	}
 	h.Observe(m.Value)
 
+	if s.sendMetricsToAppInsights {
+		s.aggregate(m)
+	}
+
 	if s.capture != nil {
 		ce := &CapturedEvent{
 			SinkType: logTypeMetrics,
@@ -174,22 +368,165 @@ func (s *standardSink) handleHistogram(m Metric) {
 	}
 }
 
+func (s *standardSink) handleSummary(m Metric) {
+	h, err := s.m.getSummary(m)
+	if err != nil {
+		s.error(err, nil)
+		return
+	}
+	h.Observe(m.Value)
+
+	if s.sendMetricsToAppInsights {
+		s.aggregate(m)
+	}
+
+	if s.capture != nil {
+		ce := &CapturedEvent{
+			SinkType: logTypeMetrics,
+			Type:     "Summary",
+			Event:    h,
+		}
+		s.capture.Capture(ce)
+	}
+}
+
+func (s *standardSink) dependency(d Dependency) {
+	dependency := appinsights.NewRemoteDependencyTelemetry(d.Name, d.Type, d.Target, d.Success)
+	dependency.ResultCode = d.ResultCode
+	dependency.Data = d.Data
+	dependency.Duration = d.Duration
+	if !d.Start.IsZero() {
+		dependency.Timestamp = d.Start
+	}
+	dependency.Properties = s.merge(d.Properties)
+	s.track(dependency)
+	if s.capture != nil {
+		ce := &CapturedEvent{
+			SinkType: logTypeAppInsights,
+			Type:     "Dependency",
+			Event:    dependency,
+		}
+		s.capture.Capture(ce)
+	}
+}
+
+// selfCounter returns the counter used by the logger to report on itself. If the counter cannot be registered the
+// error is reported, and an unregistered counter is returned so that the caller can use it regardless.
+func (s *standardSink) selfCounter(m Metric) prometheus.Counter {
+	c, err := s.m.getCounter(m)
+	if err != nil {
+		s.error(err, nil)
+		return prometheus.NewCounter(prometheus.CounterOpts{Name: m.toPromoMetricName()})
+	}
+	return c
+}
+
+// trackAggregate sends an aggregated metric to Application Insights, with the global log info added to the labels
+// of the metric. It is only called by the aggregator, which close stops before the channel of the client is closed.
+func (s *standardSink) trackAggregate(agg *appinsights.AggregateMetricTelemetry) {
+	for k, v := range s.logInfo {
+		agg.Properties[k] = v
+	}
+	if s.client != nil {
+		s.client.Track(agg)
+	}
+	if s.capture != nil {
+		ce := &CapturedEvent{
+			SinkType: logTypeAppInsights,
+			Type:     "AggregateMetric",
+			Event:    agg,
+		}
+		s.capture.Capture(ce)
+	}
+}
+
+func (s *standardSink) metrics() *metricVectors {
+	return s.m
+}
+
 func (s *standardSink) logMetric(m Metric) {
 	name := m.toPromoMetricName()
 	aiMetric := appinsights.NewMetricTelemetry(name, m.Value)
-	if s.client != nil {
-		s.client.Track(aiMetric)
+	aiMetric.Properties = s.merge(m.ConstLabels)
+	s.track(aiMetric)
+	if s.capture != nil {
+		ce := &CapturedEvent{
+			SinkType: logTypeAppInsights,
+			Type:     "Metric",
+			Event:    aiMetric,
+		}
+		s.capture.Capture(ce)
+	}
+}
+
+// track sends the telemetry item to Application Insights, unless the sink is closed.
+func (s *standardSink) track(item appinsights.Telemetry) {
+	s.closedMux.RLock()
+	defer s.closedMux.RUnlock()
+	if s.closed || s.client == nil {
+		return
 	}
+	s.client.Track(item)
+}
+
+// aggregate adds the value of the metric to its aggregate, unless the sink is closed.
+func (s *standardSink) aggregate(m Metric) {
+	s.closedMux.RLock()
+	defer s.closedMux.RUnlock()
+	if s.closed {
+		return
+	}
+	s.aggregator.add(m.toPromoMetricName(), m.ConstLabels, m.Value)
+}
+
+// close sends the metrics aggregated so far and flushes Application Insights. Only the first call has any effect.
+// Telemetry tracked after close is called is discarded, as the channel of the client is closed.
+func (s *standardSink) close(timeout time.Duration) {
+	s.closeOnce.Do(func() {
+		// Waits for the telemetry being tracked, and keeps any more from reaching the aggregator or the client.
+		s.closedMux.Lock()
+		s.closed = true
+		s.closedMux.Unlock()
+
+		if s.aggregator != nil {
+			s.aggregator.close()
+		}
+		if s.client == nil {
+			return
+		}
+		select {
+		case <-s.client.Channel().Close(timeout):
+		case <-time.After(timeout):
+		}
+	})
+}
+
+// writeEntry completes e with the current time and the names given to Named, and writes it to the writer using the
+// formatter.
+func (s *standardSink) writeEntry(e LogEntry) {
+	e.Time = time.Now()
+	e.System = s.systemName
+	e.App = s.appName
+	s.write(s.formatter.Format(e))
+}
+
+// write serializes writes to the writer, which may be used from several go routines.
+func (s *standardSink) write(p []byte) {
+	s.writerMux.Lock()
+	defer s.writerMux.Unlock()
+	s.writer.Write(p)
 }
 
+// merge returns a new map containing data as well as the global log info.
 func (s *standardSink) merge(data map[string]string) map[string]string {
-	if data == nil || len(data) == 0 {
-		return s.logInfo
+	merged := make(map[string]string, len(data)+len(s.logInfo))
+	for k, v := range data {
+		merged[k] = v
 	}
 	for k, v := range s.logInfo {
-		data[k] = v
+		merged[k] = v
 	}
-	return data
+	return merged
 }
 
 func (s *standardSink) GetSubscriptionSpec() vault.SecretSubscriptionSpec {
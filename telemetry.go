@@ -0,0 +1,171 @@
+package telemetry
+
+import (
+	"context"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"time"
+)
+
+const (
+	defaultShutdownTimeout = 5 * time.Second
+	defaultDiscardPeriod   = 30 * time.Second
+	panicsMetricName       = "telemetry_panics_total"
+	panicsMetricHelp       = "The total number of panics recovered while handling telemetry."
+)
+
+// Telemetry sends telemetry directly to Application Insights, Prometheus and the other configured destinations.
+// It is an alternative to LogChannels for hot paths, as the telemetry is handled on the calling go routine. All
+// methods are safe for concurrent use, which means that an EventCapture or io.Writer given as option must be so
+// as well.
+type Telemetry struct {
+	sink            sink
+	gatherer        prometheus.Gatherer
+	panics          prometheus.Counter
+	shutdownTimeout time.Duration
+	discardPeriod   time.Duration
+	bufferSize      int
+	overflows       map[Channel]OverflowPolicy
+}
+
+// New creates a Telemetry instance configured by the given options.
+func New(opts ...Option) *Telemetry {
+	collector := &OptionsCollector{
+		sendMetricsToAppInsights: false,
+		empty:                    false,
+		shutdownTimeout:          defaultShutdownTimeout,
+		discardPeriod:            defaultDiscardPeriod,
+		aggregationInterval:      defaultAggregationInterval,
+	}
+	registry := prometheus.NewRegistry()
+	collector.registerer = registry
+	collector.gatherer = registry
+	for _, opt := range opts {
+		opt(collector)
+	}
+
+	s := newSink(collector)
+	return &Telemetry{
+		sink:            s,
+		gatherer:        collector.gatherer,
+		panics:          s.selfCounter(Metric{Name: panicsMetricName, Help: panicsMetricHelp}),
+		shutdownTimeout: collector.shutdownTimeout,
+		discardPeriod:   collector.discardPeriod,
+		bufferSize:      collector.bufferSize,
+		overflows:       collector.overflowPolicies,
+	}
+}
+
+// Count increases the named Prometheus counter.
+func (t *Telemetry) Count(m Metric) {
+	defer t.recoverPanic()
+	t.sink.handleCounter(m)
+}
+
+// SetGauge sets the named Prometheus gauge.
+func (t *Telemetry) SetGauge(m Metric) {
+	defer t.recoverPanic()
+	t.sink.handleGauge(m)
+}
+
+// Observe observes the named Prometheus histogram.
+func (t *Telemetry) Observe(m Metric) {
+	defer t.recoverPanic()
+	t.sink.handleHistogram(m)
+}
+
+// ObserveSummary observes the named Prometheus summary.
+func (t *Telemetry) ObserveSummary(m Metric) {
+	defer t.recoverPanic()
+	t.sink.handleSummary(m)
+}
+
+// Event sends the event to Application Insights.
+func (t *Telemetry) Event(e Event) {
+	defer t.recoverPanic()
+	t.sink.logEvent(e.Name, e.Data)
+}
+
+// Error sends the error to Application Insights as an exception, with the stack trace of the caller unless an error
+// in the chain of wrapped errors holds one, see WithStack. The errors it wraps, the properties of errors implementing
+// ErrorProperties and the names given to Named are added to the exception as custom dimensions.
+func (t *Telemetry) Error(err error) {
+	defer t.recoverPanic()
+	t.sink.error(err, callers(1))
+}
+
+// queuedError reports an error received on ErrorChan. Unlike Error, the stack trace of the caller is not captured,
+// as it would be the one of the logger.
+func (t *Telemetry) queuedError(err error) {
+	defer t.recoverPanic()
+	t.sink.error(err, nil)
+}
+
+// Debug prints a debug message to the writer, unless the minimum level is above LevelDebug.
+func (t *Telemetry) Debug(d string) {
+	defer t.recoverPanic()
+	t.sink.debug(d)
+}
+
+// Trace sends the trace message to Application Insights and writes it to the writer, unless its level is below the
+// minimum level.
+func (t *Telemetry) Trace(tr Trace) {
+	defer t.recoverPanic()
+	t.sink.trace(tr)
+}
+
+// Dependency sends the call to a dependency to Application Insights.
+func (t *Telemetry) Dependency(d Dependency) {
+	defer t.recoverPanic()
+	t.sink.dependency(d)
+}
+
+// MetricsHandler returns a http.Handler that exposes the Prometheus metrics maintained by this instance, i.e. the
+// metrics of the registry set by WithPrometheusRegistry or of the private registry created by New.
+func (t *Telemetry) MetricsHandler() http.Handler {
+	return promhttp.HandlerFor(t.gatherer, promhttp.HandlerOpts{})
+}
+
+// Shutdown flushes Application Insights, waiting at most the shutdown timeout or until ctx expires. Telemetry sent
+// after Shutdown is called is not delivered to Application Insights.
+func (t *Telemetry) Shutdown(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		t.sink.close(t.shutdownTimeout)
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// recoverPanic must be deferred. It recovers a panic, counts it and reports it as an error with the stack
+// trace of the panic.
+func (t *Telemetry) recoverPanic() {
+	r := recover()
+	if r == nil {
+		return
+	}
+	t.panics.Inc()
+
+	// Reporting the panic may itself panic, for instance if the capture is the culprit.
+	defer func() {
+		_ = recover()
+	}()
+	// The stack is still the one of the panic, skipping recoverPanic and runtime.gopanic.
+	t.sink.error(&panicError{value: r}, callers(2))
+}
+
+// panicError is reported when a panic is recovered while handling telemetry.
+type panicError struct {
+	value interface{}
+}
+
+func (p *panicError) Error() string {
+	return fmt.Sprintf("recovered panic in telemetry logger: %v", p.value)
+}
@@ -0,0 +1,407 @@
+package telemetry
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/microsoft/ApplicationInsights-Go/appinsights"
+	"github.com/prometheus/client_golang/prometheus"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTelemetry_concurrentUse(t *testing.T) {
+	// Arrange
+	tm := New(Empty())
+	wg := &sync.WaitGroup{}
+
+	// Act
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				tm.Count(Metric{
+					Name:        "requests",
+					Value:       1,
+					ConstLabels: map[string]string{"handler": "costs"},
+				})
+				tm.SetGauge(Metric{Name: "temp", Value: 12})
+				tm.Observe(Metric{Name: "latency", Value: 100})
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Assert
+	body := scrapeHandler(tm.MetricsHandler())
+	expected := []string{
+		`requests{handler="costs"} 1000`,
+		"temp 12",
+		"latency_count 1000",
+	}
+	for _, e := range expected {
+		if !strings.Contains(body, e) {
+			t.Errorf("expected body to contain %s", e)
+		}
+	}
+}
+
+func TestTelemetry_SetGauge_operations(t *testing.T) {
+	// Arrange
+	tm := New(Empty())
+	wg := &sync.WaitGroup{}
+	tm.SetGauge(Metric{Name: "Concurrent handlers", Value: 10})
+
+	// Act
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				tm.SetGauge(Metric{Name: "Concurrent handlers", GaugeOperation: GaugeInc})
+				tm.SetGauge(Metric{Name: "Concurrent handlers", Value: 3, GaugeOperation: GaugeAdd})
+				tm.SetGauge(Metric{Name: "Concurrent handlers", Value: 3, GaugeOperation: GaugeSub})
+				tm.SetGauge(Metric{Name: "Concurrent handlers", GaugeOperation: GaugeDec})
+			}
+		}()
+	}
+	wg.Wait()
+	tm.SetGauge(Metric{Name: "Concurrent handlers", GaugeOperation: GaugeInc})
+	tm.SetGauge(Metric{Name: "Last run", GaugeOperation: GaugeSetToCurrentTime})
+
+	// Assert
+	body := scrapeHandler(tm.MetricsHandler())
+	if !strings.Contains(body, "concurrent_handlers 11") {
+		t.Errorf("expected gauge to be 11, got %s", body)
+	}
+	if !strings.Contains(body, "last_run 1.") {
+		t.Errorf("expected gauge to be set to the current time, got %s", body)
+	}
+}
+
+func Test_gaugeValue(t *testing.T) {
+	// Arrange
+	g := prometheus.NewGauge(prometheus.GaugeOpts{Name: "temp"})
+	g.Set(12.5)
+
+	// Act
+	v := gaugeValue(g)
+
+	// Assert
+	if v != 12.5 {
+		t.Errorf("expected 12.5, got %v", v)
+	}
+}
+
+func TestTelemetry_logging(t *testing.T) {
+	// Arrange
+	buf := new(bytes.Buffer)
+	tm := New(
+		Empty(),
+		Named("monitoring", "cost-monitor"),
+		WithWriter(buf))
+
+	// Act
+	tm.Debug("debug")
+	tm.Event(Event{
+		Name: "Start",
+		Data: map[string]string{"handler": "h"},
+	})
+	tm.Error(errors.New("an error occurred"))
+
+	// Assert
+	output := buf.String()
+	expected := []string{"debug", "EVENT(Start) map[app:cost-monitor handler:h system:monitoring]", "an error occurred"}
+	for _, e := range expected {
+		if !strings.Contains(output, e) {
+			t.Errorf("expected %s, couldn't find it", e)
+		}
+	}
+}
+
+func TestTelemetry_Count_negative(t *testing.T) {
+	// Arrange
+	buf := new(bytes.Buffer)
+	tm := New(Empty(), WithWriter(buf), WithFormatter(JSONFormatter()))
+
+	// Act
+	tm.Count(Metric{Name: "cost", Value: -1})
+
+	// Assert
+	if !strings.Contains(buf.String(), `"message":"counter cost cannot decrease, value: -1"`) {
+		t.Errorf("expected the negative value to be reported as an error by the formatter, got %s", buf.String())
+	}
+	if body := scrapeHandler(tm.MetricsHandler()); !strings.Contains(body, `errors_total{class="errors.errorString"} 1`) {
+		t.Errorf("expected the negative value to be counted as an error, got %s", body)
+	}
+}
+
+func TestTelemetry_channelsAdapter(t *testing.T) {
+	// Arrange
+	tm := New(Empty())
+	logChannels := tm.Start(context.Background())
+
+	// Act
+	logChannels.CountChan <- Metric{Name: "from channel", Value: 1}
+	tm.Count(Metric{Name: "from channel", Value: 1})
+	_ = logChannels.Shutdown(context.Background())
+
+	// Assert
+	if !strings.Contains(scrapeHandler(tm.MetricsHandler()), "from_channel 2") {
+		t.Error("expected channel and direct calls to update the same counter")
+	}
+}
+
+func TestTelemetry_Count_sendsDimensionsToAppInsights(t *testing.T) {
+	// Arrange
+	cpt := &syncCapture{}
+	tm := New(
+		Empty(),
+		Named("monitoring", "cost-monitor"),
+		SendMetricsToAppInsights(),
+		WithCapture(cpt))
+	defer tm.Shutdown(context.Background())
+
+	// Act
+	tm.Count(Metric{
+		Name:        "cost",
+		Value:       2,
+		ConstLabels: map[string]string{"cloud": "gcp"},
+	})
+
+	// Assert
+	var metric *appinsights.MetricTelemetry
+	for _, ce := range cpt.events() {
+		if ce.Type == "Metric" {
+			metric = ce.Event.(*appinsights.MetricTelemetry)
+		}
+	}
+	if metric == nil {
+		t.Fatal("expected metric to be sent to Application Insights")
+	}
+	expected := map[string]string{"cloud": "gcp", "system": "monitoring", "app": "cost-monitor"}
+	for k, v := range expected {
+		if metric.Properties[k] != v {
+			t.Errorf("expected property %s to be %s, got %s", k, v, metric.Properties[k])
+		}
+	}
+}
+
+func TestTelemetry_Trace(t *testing.T) {
+	// Arrange
+	buf := new(bytes.Buffer)
+	cpt := &syncCapture{}
+	tm := New(
+		Empty(),
+		Named("monitoring", "cost-monitor"),
+		WithWriter(buf),
+		WithCapture(cpt))
+
+	// Act
+	tm.Trace(Trace{
+		Level:   LevelWarning,
+		Message: "cost file was empty",
+		Fields:  map[string]string{"file": "costs.csv"},
+	})
+
+	// Assert
+	expected := "TRACE(Warning) cost file was empty map[app:cost-monitor file:costs.csv system:monitoring]"
+	if !strings.Contains(buf.String(), expected) {
+		t.Errorf("expected %s, got %s", expected, buf.String())
+	}
+	events := cpt.events()
+	if len(events) != 1 || events[0].Type != "Trace" {
+		t.Fatalf("expected a single trace to be captured, got %v", events)
+	}
+	trace := events[0].Event.(*appinsights.TraceTelemetry)
+	if trace.SeverityLevel != appinsights.Warning {
+		t.Errorf("expected severity Warning, got %v", trace.SeverityLevel)
+	}
+	if trace.Properties["file"] != "costs.csv" || trace.Properties["system"] != "monitoring" {
+		t.Errorf("unexpected properties %v", trace.Properties)
+	}
+}
+
+func TestTelemetry_Trace_minimumLevel(t *testing.T) {
+	// Arrange
+	buf := new(bytes.Buffer)
+	tm := New(
+		Empty(),
+		WithWriter(buf),
+		WithMinimumLevel(LevelWarning))
+
+	// Act
+	tm.Debug("debug")
+	tm.Trace(Trace{Level: LevelInfo, Message: "info"})
+	tm.Trace(Trace{Level: LevelError, Message: "error"})
+
+	// Assert
+	output := buf.String()
+	if strings.Contains(output, "debug") || strings.Contains(output, "info") {
+		t.Errorf("expected messages below the minimum level to be discarded, got %s", output)
+	}
+	if !strings.Contains(output, "TRACE(Error) error") {
+		t.Errorf("expected the error trace to be written, got %s", output)
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    Level
+		wantErr bool
+	}{
+		{s: "debug", want: LevelDebug},
+		{s: "Info", want: LevelInfo},
+		{s: "WARNING", want: LevelWarning},
+		{s: "error", want: LevelError},
+		{s: "critical", want: LevelCritical},
+		{s: "verbose", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.s, func(t *testing.T) {
+			got, err := ParseLevel(tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseLevel(%q) error = %v, wantErr %v", tt.s, err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("ParseLevel(%q) = %v, want %v", tt.s, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWithPrometheusRegistry_nilGatherer(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	tests := []struct {
+		name       string
+		registerer prometheus.Registerer
+		wantCode   int
+		wantBody   string
+	}{
+		{
+			name:       "registry",
+			registerer: registry,
+			wantCode:   http.StatusOK,
+			wantBody:   "cost 1",
+		},
+		{
+			name:       "registerer only",
+			registerer: struct{ prometheus.Registerer }{prometheus.NewRegistry()},
+			wantCode:   http.StatusInternalServerError,
+			wantBody:   "no gatherer was given by WithPrometheusRegistry",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tm := New(Empty(), WithPrometheusRegistry(tt.registerer, nil))
+			tm.Count(Metric{Name: "cost", Value: 1})
+
+			rr := httptest.NewRecorder()
+			tm.MetricsHandler().ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+
+			if rr.Code != tt.wantCode || !strings.Contains(rr.Body.String(), tt.wantBody) {
+				t.Errorf("expected %d %s, got %d %s", tt.wantCode, tt.wantBody, rr.Code, rr.Body.String())
+			}
+		})
+	}
+}
+
+func TestTelemetry_Shutdown_concurrentUse(t *testing.T) {
+	// Arrange
+	tm := New(
+		Empty(),
+		SendMetricsToAppInsights(),
+		AggregateMetricsInAppInsights(),
+		WithShutdownTimeout(10*time.Millisecond))
+	client := &closingClient{}
+	tm.sink.(*standardSink).client = client
+	stop := make(chan struct{})
+	wg := &sync.WaitGroup{}
+
+	// Act
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				tm.Event(Event{Name: "costs_calculated"})
+				tm.Count(Metric{Name: "cost", Value: 1})
+				tm.Observe(Metric{Name: "latency", Value: 100})
+				tm.Error(errors.New("calculation failed"))
+				tm.Trace(Trace{Message: "calculating", Level: LevelInfo})
+			}
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	_ = tm.Shutdown(context.Background())
+	time.Sleep(10 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+
+	// Assert
+	tracked, trackedAfterClose := client.counts()
+	if tracked == 0 {
+		t.Error("expected telemetry sent before Shutdown to be tracked")
+	}
+	if trackedAfterClose != 0 {
+		t.Errorf("did not expect telemetry to be tracked after Shutdown, got %d items", trackedAfterClose)
+	}
+	if body := scrapeHandler(tm.MetricsHandler()); !strings.Contains(body, "telemetry_panics_total 0") {
+		t.Errorf("did not expect telemetry sent during or after Shutdown to panic, got %s", body)
+	}
+}
+
+// closingClient is an Application Insights client that counts the telemetry tracked before and after its channel
+// is closed.
+type closingClient struct {
+	appinsights.TelemetryClient
+	mux               sync.Mutex
+	closed            bool
+	tracked           int
+	trackedAfterClose int
+}
+
+func (c *closingClient) Track(appinsights.Telemetry) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.closed {
+		c.trackedAfterClose++
+		return
+	}
+	c.tracked++
+}
+
+func (c *closingClient) Channel() appinsights.TelemetryChannel {
+	return closingChannel{client: c}
+}
+
+func (c *closingClient) counts() (int, int) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.tracked, c.trackedAfterClose
+}
+
+type closingChannel struct {
+	appinsights.TelemetryChannel
+	client *closingClient
+}
+
+func (c closingChannel) Close(retryTimeout ...time.Duration) <-chan struct{} {
+	c.client.mux.Lock()
+	defer c.client.mux.Unlock()
+	c.client.closed = true
+	done := make(chan struct{})
+	close(done)
+	return done
+}
@@ -1,6 +1,15 @@
 package telemetry
 
-import "strings"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"strings"
+	"time"
+)
 
 // LogChannels a set of channels used for communicating events, metrics, errors and
 // other telemetry types to the logger.
@@ -14,7 +23,10 @@ type LogChannels struct {
 	// HistogramChan observes the named Prometheus histogram.
 	HistogramChan chan Metric
 
-	// ErrorChan sends the error to Application Insights.
+	// SummaryChan observes the named Prometheus summary.
+	SummaryChan chan Metric
+
+	// ErrorChan sends the error to Application Insights. A nil error is ignored.
 	ErrorChan chan error
 
 	// EventChan sends the event to Application Insights.
@@ -22,6 +34,51 @@ type LogChannels struct {
 
 	// DebugChan prints a debug message to the console.
 	DebugChan chan string
+
+	// TraceChan sends the trace message to Application Insights and writes it to the writer, unless its level is
+	// below the minimum level.
+	TraceChan chan Trace
+
+	// DependencyChan sends the call to a dependency to Application Insights.
+	DependencyChan chan Dependency
+
+	done       <-chan struct{}
+	cancel     context.CancelFunc
+	gatherer   prometheus.Gatherer
+	gaugeDrops bool
+}
+
+// MetricsHandler returns a http.Handler that exposes the Prometheus metrics maintained by the logger, i.e. the
+// metrics of the registry set by WithPrometheusRegistry or of the private registry created by Start.
+func (l LogChannels) MetricsHandler() http.Handler {
+	g := l.gatherer
+	if g == nil {
+		g = prometheus.DefaultGatherer
+	}
+	return promhttp.HandlerFor(g, promhttp.HandlerOpts{})
+}
+
+// Done returns a channel that is closed when the logger has stopped and all queued telemetry has been flushed
+// (or the shutdown timeout has expired).
+func (l LogChannels) Done() <-chan struct{} {
+	return l.done
+}
+
+// Shutdown stops the logger and waits until all queued telemetry has been delivered. If ctx expires before that
+// happens, the context error is returned. Telemetry sent on the channels after the logger has stopped is discarded
+// and counted by the Prometheus counter telemetry_dropped_total, so that senders do not block. This keeps one go
+// routine running for the period set by WithDiscardPeriod.
+func (l LogChannels) Shutdown(ctx context.Context) error {
+	if l.cancel == nil {
+		return nil
+	}
+	l.cancel()
+	select {
+	case <-l.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 // Metric is a named numeric value.
@@ -29,16 +86,121 @@ type Metric struct {
 	Name        string
 	Value       float64
 	ConstLabels map[string]string
+
+	// Help describes the metric in Prometheus. Defaults to Name.
+	Help string
+
+	// Namespace is the first part of the Prometheus name of the metric. Defaults to the system name given to Named
+	// if the option NamedAsNamespace is used.
+	Namespace string
+
+	// Subsystem is the second part of the Prometheus name of the metric. Defaults to the application name given to
+	// Named if the option NamedAsNamespace is used.
+	Subsystem string
+
+	// GaugeOperation is the operation applied to a gauge. Defaults to GaugeSet. Not used for other metric types.
+	GaugeOperation GaugeOperation
 }
 
+// GaugeOperation is an operation that changes the value of a gauge. Operations other than GaugeSet change the
+// gauge relative to its current value, so that a gauge may be maintained from many go routines. NB! Relative
+// operations must not be sent on a channel with a drop policy, as a dropped increase or decrease makes the gauge drift
+// for good.
+type GaugeOperation int
+
+const (
+	// GaugeSet sets the gauge to Value.
+	GaugeSet GaugeOperation = iota
+
+	// GaugeAdd adds Value to the gauge.
+	GaugeAdd
+
+	// GaugeSub subtracts Value from the gauge.
+	GaugeSub
+
+	// GaugeInc increases the gauge by one, Value is ignored.
+	GaugeInc
+
+	// GaugeDec decreases the gauge by one, Value is ignored.
+	GaugeDec
+
+	// GaugeSetToCurrentTime sets the gauge to the current Unix time in seconds, Value is ignored.
+	GaugeSetToCurrentTime
+)
+
 func (m Metric) toPromoMetricName() string {
 	return promoMetricName(m.Name)
 }
 
+func (m Metric) help() string {
+	if m.Help != "" {
+		return m.Help
+	}
+	return m.Name
+}
+
 func promoMetricName(n string) string {
-	ss := strings.ReplaceAll(n, " ", "_")
-	ss = strings.ReplaceAll(ss, "-", "_")
-	return strings.ToLower(ss)
+	return sanitizeName(strings.ToLower(n), true)
+}
+
+func promoLabelName(n string) string {
+	return sanitizeName(n, false)
+}
+
+// sanitizeName maps n onto the Prometheus name grammar. Every run of runes that are not allowed in the name is
+// replaced by a single underscore, except at the start and at the end of the name where such runs are removed.
+// Names starting with a digit are prefixed by an underscore, and the reserved prefix "__" is reduced to a single
+// underscore. Colons are allowed in metric names only.
+func sanitizeName(n string, allowColon bool) string {
+	var b strings.Builder
+	pending := false
+	for _, r := range n {
+		if !validNameRune(r, allowColon) {
+			pending = true
+			continue
+		}
+		if pending && b.Len() > 0 {
+			b.WriteByte('_')
+		}
+		pending = false
+		b.WriteRune(r)
+	}
+	s := b.String()
+	for strings.HasPrefix(s, "__") {
+		s = s[1:]
+	}
+	if s != "" && s[0] >= '0' && s[0] <= '9' {
+		s = "_" + s
+	}
+	return s
+}
+
+// checkName returns an error unless n becomes a valid Prometheus name by replacing spaces and hyphens by
+// underscores.
+func checkName(n string, allowColon bool) error {
+	if n == "" {
+		return errors.New("name is empty")
+	}
+	if n[0] >= '0' && n[0] <= '9' {
+		return errors.New("name starts with a digit")
+	}
+	if strings.HasPrefix(n, "__") {
+		return errors.New("names starting with __ are reserved")
+	}
+	for _, r := range n {
+		if r != ' ' && r != '-' && !validNameRune(r, allowColon) {
+			return fmt.Errorf("%q is not allowed", r)
+		}
+	}
+	return nil
+}
+
+func validNameRune(r rune, allowColon bool) bool {
+	return (r >= 'a' && r <= 'z') ||
+		(r >= 'A' && r <= 'Z') ||
+		(r >= '0' && r <= '9') ||
+		r == '_' ||
+		(allowColon && r == ':')
 }
 
 // Event is raised when something interesting happens in the application. Consists
@@ -48,6 +210,35 @@ type Event struct {
 	Data map[string]string
 }
 
+// Dependency is a call from the application to another service, for instance a http request to another API. It is
+// sent to Application Insights as a remote dependency.
+type Dependency struct {
+	// Name of the call, with low cardinality, for instance "GET /costs".
+	Name string
+
+	// Type of the dependency, for instance "HTTP" or "SQL".
+	Type string
+
+	// Target of the call, for instance the host name of the service.
+	Target string
+
+	// Data is the command of the call, for instance the URL of a http request.
+	Data string
+
+	// ResultCode is the result of the call, for instance the http status code.
+	ResultCode string
+
+	// Success tells whether the call succeeded.
+	Success bool
+
+	// Start is when the call was made, and Duration how long it took.
+	Start    time.Time
+	Duration time.Duration
+
+	// Properties are added to the dependency as custom dimensions, in addition to the names given to Named.
+	Properties map[string]string
+}
+
 // EventCapture is able to capture events. This is mostly useful in testing scenarios when
 // one wishes to verify that the expected events are logged.
 type EventCapture interface {
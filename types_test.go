@@ -0,0 +1,71 @@
+package telemetry
+
+import "testing"
+
+func Test_promoMetricName(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected string
+	}{
+		{"Events handled", "events_handled"},
+		{"http-requests", "http_requests"},
+		{"Cost (NOK)/day", "cost_nok_day"},
+		{"p95.latency", "p95_latency"},
+		{"95th percentile", "_95th_percentile"},
+		{"__internal", "_internal"},
+		{"namespace:rule", "namespace:rule"},
+		{"Temperatur på badet", "temperatur_p_badet"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := promoMetricName(tt.name); got != tt.expected {
+				t.Errorf("promoMetricName() = %v, want %v", got, tt.expected)
+			}
+		})
+	}
+}
+
+func Test_promoLabelName(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected string
+	}{
+		{"cloud", "cloud"},
+		{"Cloud Provider", "Cloud_Provider"},
+		{"a:b", "a_b"},
+		{"1st", "_1st"},
+		{"__name__", "_name__"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := promoLabelName(tt.name); got != tt.expected {
+				t.Errorf("promoLabelName() = %v, want %v", got, tt.expected)
+			}
+		})
+	}
+}
+
+func Test_checkName(t *testing.T) {
+	tests := []struct {
+		name       string
+		allowColon bool
+		valid      bool
+	}{
+		{"Events handled", true, true},
+		{"http-requests", true, true},
+		{"namespace:rule", true, true},
+		{"namespace:rule", false, false},
+		{"Cost (NOK)/day", true, false},
+		{"p95.latency", true, false},
+		{"95th percentile", true, false},
+		{"__internal", true, false},
+		{"", true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := checkName(tt.name, tt.allowColon); (err == nil) != tt.valid {
+				t.Errorf("checkName() error = %v, want valid %v", err, tt.valid)
+			}
+		})
+	}
+}